@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// account is one SmugMug account to sync. With -accounts, each account
+// comes from the file; otherwise there is one, from the usual options.
+type account struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	APIKey   string `json:"apikey"`
+
+	// Dir is the account's subdirectory of -dir, which defaults to Name.
+	Dir string `json:"dir"`
+
+	provider authProvider
+}
+
+// loadAccounts reads a JSON list of accounts for -accounts. Credentials
+// an account leaves out are taken from the usual options, so a shared
+// API key only needs to be given once.
+func loadAccounts(path string) ([]*account, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read accounts file %s: %v", path, err)
+	}
+	var list []*account
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse accounts file %s: %v", path, err)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("accounts file %s lists no accounts", path)
+	}
+
+	seen := make(map[string]bool)
+	for i, a := range list {
+		if a.Name == "" {
+			return nil, fmt.Errorf("accounts file %s: account %d has no name", path, i+1)
+		}
+		if a.Dir == "" {
+			a.Dir = sanitizeName(a.Name)
+		}
+		a.Dir = filepath.Clean(a.Dir)
+		if filepath.IsAbs(a.Dir) || a.Dir == "." || a.Dir == ".." || strings.HasPrefix(a.Dir, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("accounts file %s: directory %q of account %s is not inside the target directory", path, a.Dir, a.Name)
+		}
+		if seen[a.Dir] {
+			return nil, fmt.Errorf("accounts file %s: more than one account uses directory %s", path, a.Dir)
+		}
+		seen[a.Dir] = true
+
+		if a.Email == "" {
+			a.Email = email
+		}
+		if a.Password == "" {
+			a.Password = password
+		}
+		if a.APIKey == "" {
+			a.APIKey = apiKey
+		}
+	}
+	return list, nil
+}
+
+// use sets the credential options to the account's values,
+// so the auth providers pick them up.
+func (a *account) use() {
+	email, password, apiKey = a.Email, a.Password, a.APIKey
+}
+
+// accountResult is what syncAccount did for one account.
+type accountResult struct {
+	name      string
+	albums    int
+	completed int64
+	files     int64
+	bytes     int64
+	failures  []string
+}
+
+// label names the account in summary lines when there are several.
+func (r *accountResult) label() string {
+	if r.name == "" {
+		return ""
+	}
+	return " in account " + r.name
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// rampUpAfter is the number of successful requests in a row after
+// which adaptive concurrency allows one more album at a time.
+const rampUpAfter = 20
+
+// throttleCooldown is how long adaptive concurrency waits after
+// cutting back before it will cut back again, since one burst of
+// throttling usually shows up in several requests at once.
+const throttleCooldown = 10 * time.Second
+
+// concurrency limits how many albums are processed at once, for
+// -adaptive-jobs. The limit starts at -jobs, halves when a request is
+// throttled or its connection is reset, and grows back by one after
+// each run of successes. All methods do nothing on a nil controller.
+type concurrency struct {
+	sync.Mutex
+	cond      *sync.Cond
+	limit     int
+	max       int
+	active    int
+	successes int
+	cutAt     time.Time
+}
+
+// adapt is nil unless -adaptive-jobs is set.
+var adapt *concurrency
+
+func newConcurrency(max int) *concurrency {
+	c := &concurrency{limit: max, max: max}
+	c.cond = sync.NewCond(c)
+	return c
+}
+
+// acquire waits until another album may start.
+func (c *concurrency) acquire() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for c.active >= c.limit {
+		c.cond.Wait()
+	}
+	c.active++
+}
+
+// release marks an album as finished.
+func (c *concurrency) release() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.active--
+	c.cond.Broadcast()
+}
+
+// throttled records a throttled request or reset connection.
+func (c *concurrency) throttled() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.successes = 0
+	now := clk.Now()
+	if c.limit == 1 || now.Sub(c.cutAt) < throttleCooldown {
+		return
+	}
+	c.limit /= 2
+	c.cutAt = now
+	logWarn(event{}, "Warning: throttled, processing %d albums at a time", c.limit)
+}
+
+// succeeded records a successful request.
+func (c *concurrency) succeeded() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.successes++
+	if c.successes >= rampUpAfter && c.limit < c.max {
+		c.limit++
+		c.successes = 0
+		log.Printf("Processing %d albums at a time", c.limit)
+		c.cond.Broadcast()
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiLimiter spaces out SmugMug API calls. It is shared by all album
+// jobs, so a throttling response slows every caller, not just the one
+// that received it.
+type apiLimiter struct {
+	sync.Mutex
+	interval time.Duration // zero for unlimited
+	next     time.Time
+}
+
+// apiLimit governs all API calls made after login.
+var apiLimit = &apiLimiter{}
+
+func newAPILimiter(perSecond float64) *apiLimiter {
+	l := &apiLimiter{}
+	if perSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return l
+}
+
+// wait blocks until another API call may be made.
+func (l *apiLimiter) wait() {
+	l.Lock()
+	now := clk.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.Unlock()
+	time.Sleep(delay)
+}
+
+// hold stops all API calls for at least d.
+func (l *apiLimiter) hold(d time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	if until := clk.Now().Add(d); l.next.Before(until) {
+		l.next = until
+	}
+}
+
+// statusError is an HTTP response with an unexpected status code.
+type statusError struct {
+	url  string
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code downloading %s: %d", e.url, e.code)
+}
+
+// statusPattern finds candidate status codes in an error message.
+var statusPattern = regexp.MustCompile(`\b([1-5][0-9][0-9]) `)
+
+// statusCode returns the HTTP status code an error reports, or 0 if
+// there is none. Errors from the smugmug package are only text, so a
+// code is recognized there only as a status line, e.g., "404 Not
+// Found", never from a number or phrase elsewhere in the message such
+// as an album title or file name.
+func statusCode(err error) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code
+	}
+	msg := err.Error()
+	for _, m := range statusPattern.FindAllStringSubmatchIndex(msg, -1) {
+		code, _ := strconv.Atoi(msg[m[2]:m[3]])
+		if text := http.StatusText(code); text != "" && strings.HasPrefix(msg[m[1]:], text) {
+			return code
+		}
+	}
+	return 0
+}
+
+// isThrottled reports whether an API error is a 429 Too Many Requests
+// response.
+func isThrottled(err error) bool {
+	return statusCode(err) == http.StatusTooManyRequests
+}
+
+// isReset reports whether an error is a connection reset, which
+// often means the server is shedding load.
+func isReset(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "connection reset")
+}
+
+// isAccessError reports whether an API error means the account is not
+// allowed to see an album, or the album is gone, as opposed to a
+// problem with the connection or with smugsync itself.
+func isAccessError(err error) bool {
+	switch statusCode(err) {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return true
+	}
+	return false
+}
+
+// isTransient reports whether an API error is worth retrying:
+// throttling, timeouts, dropped connections, and server errors.
+func isTransient(err error) bool {
+	switch statusCode(err) {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	msg := err.Error()
+	return strings.HasSuffix(msg, ": EOF") || strings.Contains(msg, "connection reset by peer") || strings.Contains(msg, "connection refused")
+}
+
+// callWithRetry makes an API call when the limiter allows it. Transient
+// errors are retried up to -api-retries times with exponential backoff;
+// when the server says we are going too fast, all API calls pause.
+// Once ctx is done, no further attempts are made.
+func callWithRetry(ctx context.Context, what string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		apiLimit.wait()
+		err := fn()
+		if err == nil {
+			adapt.succeeded()
+		} else if isThrottled(err) || isReset(err) {
+			adapt.throttled()
+		}
+		if err == nil || !isTransient(err) || attempt > apiRetries {
+			return err
+		}
+		delay := backoff(attempt)
+		if isThrottled(err) {
+			logWarn(event{}, "Warning: API throttled fetching %s, pausing API calls for %v (%d of %d)", what, delay.Round(time.Millisecond), attempt, apiRetries)
+			apiLimit.hold(delay)
+		} else {
+			logWarn(event{}, "Warning: error fetching %s: %v, retrying in %v (%d of %d)", what, err, delay.Round(time.Millisecond), attempt, apiRetries)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestErrorClasses(t *testing.T) {
+	tests := []struct {
+		err                                 error
+		access, transient, throttled, stale bool
+	}{
+		{errors.New("404 Not Found"), true, false, false, false},
+		{errors.New("smugmug: 403 Forbidden"), true, false, false, true},
+		{errors.New("401 Unauthorized"), true, false, false, false},
+		{errors.New("429 Too Many Requests"), false, true, true, false},
+		{errors.New("503 Service Unavailable"), false, true, false, false},
+		{&statusError{url: "https://photos.fake/a", code: 410}, false, false, false, true},
+		{&statusError{url: "https://photos.fake/a", code: 403}, true, false, false, true},
+		{fmt.Errorf("Get https://api.fake/: %w", io.ErrUnexpectedEOF), false, true, false, false},
+		{errors.New("read tcp 10.0.0.1:443: connection reset by peer"), false, true, false, false},
+
+		// numbers and phrases that are not a status
+		{errors.New(`invalid album "Page 404"`), false, false, false, false},
+		{errors.New("IMG_4290.jpg: image not found in album"), false, false, false, false},
+		{errors.New("album 5031 has 429 images"), false, false, false, false},
+		{errors.New("signature expired for key 500abc"), false, false, false, false},
+		{errors.New("file names are not unique"), false, false, false, false},
+	}
+	for _, test := range tests {
+		if got := isAccessError(test.err); got != test.access {
+			t.Errorf("isAccessError(%q) = %v", test.err, got)
+		}
+		if got := isTransient(test.err); got != test.transient {
+			t.Errorf("isTransient(%q) = %v", test.err, got)
+		}
+		if got := isThrottled(test.err); got != test.throttled {
+			t.Errorf("isThrottled(%q) = %v", test.err, got)
+		}
+		if got := isExpired(test.err); got != test.stale {
+			t.Errorf("isExpired(%q) = %v", test.err, got)
+		}
+	}
+}
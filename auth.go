@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/russross/smugmug"
+)
+
+// smugClient is the part of *smugmug.Conn that syncing uses,
+// so a fake can stand in for the SmugMug API.
+type smugClient interface {
+	NickName() string
+	Albums(nickName string) ([]*smugmug.AlbumInfo, error)
+	Images(album *smugmug.AlbumInfo) ([]*smugmug.ImageInfo, error)
+}
+
+// smugConn adapts *smugmug.Conn to smugClient.
+type smugConn struct {
+	*smugmug.Conn
+}
+
+func (c smugConn) NickName() string { return c.Conn.NickName }
+
+// authProvider logs in to SmugMug and returns a ready connection.
+type authProvider interface {
+	Login() (smugClient, error)
+}
+
+// authProviders maps the names accepted by -auth to constructors.
+// New authentication methods register themselves here.
+var authProviders = map[string]func() (authProvider, error){
+	"password": newPasswordAuth,
+}
+
+// getAuthProvider returns the provider registered under name.
+func getAuthProvider(name string) (authProvider, error) {
+	newProvider, ok := authProviders[name]
+	if !ok {
+		var names []string
+		for k := range authProviders {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown auth provider %q: must be one of %s", name, strings.Join(names, ", "))
+	}
+	return newProvider()
+}
+
+// passwordAuth logs in using an email address and password.
+type passwordAuth struct {
+	email, password, apiKey string
+}
+
+func newPasswordAuth() (authProvider, error) {
+	if email == "" || password == "" {
+		return nil, fmt.Errorf("email and password are required for password authentication")
+	}
+	return &passwordAuth{email: email, password: password, apiKey: apiKey}, nil
+}
+
+func (a *passwordAuth) Login() (smugClient, error) {
+	c, err := smugmug.Login(a.email, a.password, a.apiKey)
+	if err != nil {
+		return nil, err
+	}
+	return smugConn{c}, nil
+}
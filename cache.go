@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// cacheName is the file in the target directory that holds cached MD5 sums.
+const cacheName = ".smugsync-cache.json"
+
+// cacheEntry is the MD5 sum of a local file, which is trusted
+// as long as the file's size and modification time are unchanged.
+// With -hash-algo sha256, the SHA-256 digest is kept as well.
+type cacheEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	MD5Sum  string    `json:"md5"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Meta    string    `json:"meta,omitempty"`
+}
+
+// hashCache maps file paths (relative to dir) to cached MD5 sums.
+type hashCache struct {
+	sync.Mutex
+	entries map[string]*cacheEntry
+	dirty   bool
+}
+
+// cache is nil when caching is disabled with -no-cache.
+var cache *hashCache
+
+// loadCache reads the cache file. A missing file gives an empty cache.
+func loadCache(path string) (*hashCache, error) {
+	c := &hashCache{entries: make(map[string]*cacheEntry)}
+	data, err := store.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse cache %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// save writes the cache file if anything changed.
+func (c *hashCache) save(path string) error {
+	c.Lock()
+	defer c.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return fmt.Errorf("error encoding cache: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := store.WriteFile(tmp, data); err != nil {
+		return fmt.Errorf("failed to write cache %s: %v", tmp, err)
+	}
+	if err := store.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %v", tmp, path, err)
+	}
+	c.dirty = false
+	return nil
+}
+
+// hash returns the MD5 sum of the file at fullpath, using the cached
+// value for key if the file's size and modification time match.
+func (c *hashCache) hash(key, fullpath string, info os.FileInfo) (string, error) {
+	sum, _, err := c.sums(key, fullpath, info)
+	return sum, err
+}
+
+// sums is like hash, but also returns the -hash-algo digest of the
+// file (or "" for md5). Both are computed in a single read.
+func (c *hashCache) sums(key, fullpath string, info os.FileInfo) (string, string, error) {
+	if c != nil {
+		c.Lock()
+		entry := c.entries[key]
+		c.Unlock()
+		if entry != nil && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) &&
+			(hashAlgo != "sha256" || entry.SHA256 != "") {
+			return entry.MD5Sum, entry.SHA256, nil
+		}
+	}
+
+	extra := localDigest()
+	sum, err := hashFileWith(fullpath, extra)
+	if err != nil {
+		return "", "", err
+	}
+	var digest string
+	if extra != nil {
+		digest = hex.EncodeToString(extra.Sum(nil))
+	}
+	if c != nil {
+		c.Lock()
+		c.entries[key] = &cacheEntry{Size: info.Size(), ModTime: info.ModTime(), MD5Sum: sum, SHA256: digest}
+		c.dirty = true
+		c.Unlock()
+	}
+	return sum, digest, nil
+}
+
+// hashJob is a local file waiting to be hashed.
+type hashJob struct {
+	key      string
+	fullpath string
+	info     os.FileInfo
+}
+
+// hashFiles hashes files with -hash-jobs workers, storing each sum
+// in localFiles under the file's key. Sums are looked up in and
+// recorded to c, which may be nil to read every file. It returns the
+// first error.
+func hashFiles(c *hashCache, files []hashJob, localFiles map[string]string) error {
+	var mutex sync.Mutex
+	var failed error
+	work := make(chan hashJob)
+	var wg sync.WaitGroup
+	for i := 0; i < hashJobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range work {
+				sum, err := c.hash(job.key, job.fullpath, job.info)
+				mutex.Lock()
+				if err != nil && failed == nil {
+					failed = err
+				} else if err == nil {
+					localFiles[job.key] = sum
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, job := range files {
+		work <- job
+	}
+	close(work)
+	wg.Wait()
+	return failed
+}
+
+// record stores a known MD5 sum for key, e.g., after a verified download.
+func (c *hashCache) record(key string, info os.FileInfo, sum string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.entries[key] = &cacheEntry{Size: info.Size(), ModTime: info.ModTime(), MD5Sum: sum}
+	c.dirty = true
+}
+
+// metaChanged reports whether the metadata digest last recorded for
+// key differs from digest. Nothing recorded counts as unchanged.
+func (c *hashCache) metaChanged(key, digest string) bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	entry := c.entries[key]
+	return entry != nil && entry.Meta != "" && entry.Meta != digest
+}
+
+// recordMeta stores the metadata digest for key, if the file is in the cache.
+func (c *hashCache) recordMeta(key, digest string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if entry := c.entries[key]; entry != nil && entry.Meta != digest {
+		entry.Meta = digest
+		c.dirty = true
+	}
+}
+
+// forget drops the cached sum for key, e.g., after the file is removed.
+func (c *hashCache) forget(key string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, present := c.entries[key]; present {
+		delete(c.entries, key)
+		c.dirty = true
+	}
+}
+
+// saveCache writes the cache file unless caching is disabled
+// or this is a dry run.
+func saveCache() {
+	if cache == nil || dry {
+		return
+	}
+	if err := cache.save(filepath.Join(dir, cacheName)); err != nil {
+		logError(event{}, "Error saving MD5 cache: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// BenchmarkHashFiles hashes 5,000 small files with a single worker
+// and with one worker per CPU, bypassing the cache.
+func BenchmarkHashFiles(b *testing.B) {
+	f := newFakeSmug()
+	setup(b, f)
+	root := b.TempDir()
+	var files []hashJob
+	for i := 0; i < 5000; i++ {
+		name := fmt.Sprintf("%04d.jpg", i)
+		path := filepath.Join(root, name)
+		if err := os.WriteFile(path, []byte(fmt.Sprintf("image %d", i)), 0644); err != nil {
+			b.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		files = append(files, hashJob{key: name, fullpath: path, info: info})
+	}
+
+	for _, n := range []int{1, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("jobs=%d", n), func(b *testing.B) {
+			hashJobs = n
+			for i := 0; i < b.N; i++ {
+				localFiles := make(map[string]string)
+				if err := hashFiles(nil, files, localFiles); err != nil {
+					b.Fatal(err)
+				}
+				if len(localFiles) != len(files) {
+					b.Fatalf("hashed %d files, want %d", len(localFiles), len(files))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// checkWritable makes sure files can be created in dir.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unable to create target directory %s: %v", dir, err)
+	}
+	fp, err := ioutil.TempFile(dir, ".smugsync-write-")
+	if err != nil {
+		return fmt.Errorf("target directory %s is not writable: %v", dir, err)
+	}
+	name := fp.Name()
+	fp.Close()
+	if err := os.Remove(name); err != nil {
+		return fmt.Errorf("unable to remove files in target directory %s: %v", dir, err)
+	}
+	return nil
+}
+
+// checkFS probes the target directory to make sure it supports
+// the features the chosen options rely on. Problems that would
+// cause a sync to fail part way through are returned as errors;
+// problems that only risk surprises are logged as warnings.
+func checkFS(dir string) error {
+	probe, err := ioutil.TempDir(dir, ".smugsync-check-")
+	if err != nil {
+		return fmt.Errorf("target directory %s is not writable: %v", dir, err)
+	}
+	defer os.RemoveAll(probe)
+
+	// setting timestamps is required for -fast and -touch-only,
+	// and smugsync always sets directory timestamps
+	when := time.Date(2001, time.February, 3, 4, 5, 6, 0, clk.Location())
+	if err := os.Chtimes(probe, when, when); err != nil {
+		return fmt.Errorf("unable to set timestamps in %s: %v", dir, err)
+	}
+	info, err := os.Stat(probe)
+	if err != nil {
+		return fmt.Errorf("unable to stat %s: %v", probe, err)
+	}
+	if !info.ModTime().Equal(when) {
+		if fast || touch {
+			return fmt.Errorf("timestamps set in %s do not round trip (got %v, expected %v)", dir, info.ModTime(), when)
+		}
+		logWarn(event{}, "Warning: timestamps set in %s do not round trip (got %v, expected %v)", dir, info.ModTime(), when)
+	}
+
+	// long file names
+	long := filepath.Join(probe, strings.Repeat("x", 255))
+	if err := ioutil.WriteFile(long, nil, 0644); err != nil {
+		logWarn(event{}, "Warning: %s does not support 255-character file names: %v", dir, err)
+	}
+
+	// case sensitivity
+	lower := filepath.Join(probe, "case")
+	if err := ioutil.WriteFile(lower, nil, 0644); err != nil {
+		return fmt.Errorf("unable to create file in %s: %v", dir, err)
+	}
+	if _, err := os.Stat(filepath.Join(probe, "CASE")); err == nil {
+		logWarn(event{}, "Warning: %s is case insensitive; albums or files whose names differ only in case will collide", dir)
+	}
+
+	// hard links are how -dedup hardlink shares files
+	if dedupMode == "hardlink" {
+		if err := os.Link(lower, filepath.Join(probe, "link")); err != nil {
+			return fmt.Errorf("%s does not support hard links, which -dedup hardlink requires: %v", dir, err)
+		}
+	}
+
+	log.Printf("Target directory %s passed filesystem checks", dir)
+	return nil
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckFSHardLinks(t *testing.T) {
+	setup(t, nil)
+	checkfs, dedupMode = true, "hardlink"
+	if err := checkFS(dir); err != nil {
+		t.Errorf("checkFS with -dedup hardlink: %v", err)
+	}
+}
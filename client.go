@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// httpDoer is the part of *http.Client that downloads use,
+// so a fake can stand in for the network.
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// httpClient is shared by all downloads. It has no overall deadline,
+// since large videos can take a long time; instead, connecting,
+// waiting for response headers, and each pause while reading the
+// body are limited separately (see idleTimeoutBody).
+var httpClient httpDoer
+
+// downloadHeader holds the -user-agent and -header values,
+// which are sent with every download request.
+var downloadHeader http.Header
+
+// parseHeaders parses header values given as "Name: value".
+func parseHeaders(list []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, elt := range list {
+		parts := strings.SplitN(elt, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("%q is not of the form Name: value", elt)
+		}
+		header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return header, nil
+}
+
+// newHTTPClient returns a client whose transport opens at most
+// -max-conns connections to each host and keeps that many idle ones
+// around for reuse, so that downloads do not churn TCP connections.
+func newHTTPClient(timeout, dialTimeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   dialTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   dialTimeout,
+			ResponseHeaderTimeout: timeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxConnsPerHost:       maxConns,
+			MaxIdleConnsPerHost:   maxConns,
+		},
+	}
+}
+
+// idleTimeoutBody cancels a request if no data arrives for timeout.
+// The timer resets on every read, so a slow but steady download
+// is never cut off.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+	cancel  context.CancelFunc
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// doWithTimeout sends a request using httpClient and wraps the
+// response body so that reads stall for at most timeout.
+func doWithTimeout(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &idleTimeoutBody{
+		ReadCloser: resp.Body,
+		timer:      time.AfterFunc(timeout, cancel),
+		timeout:    timeout,
+		cancel:     cancel,
+	}
+	return resp, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// clock is the source of the current time and local time zone
+// for timestamp and scheduling logic, so it can be faked in tests.
+type clock interface {
+	Now() time.Time
+	Location() *time.Location
+}
+
+// clk is the clock used throughout smugsync.
+var clk clock = realClock{}
+
+// realClock uses the system clock and time zone.
+type realClock struct{}
+
+func (realClock) Now() time.Time           { return time.Now() }
+func (realClock) Location() *time.Location { return time.Local }
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+	loc *time.Location
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, loc: now.Location()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Location() *time.Location {
+	return c.loc
+}
+
+// Advance moves the fake clock forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// since is like time.Since but uses clk.
+func since(t time.Time) time.Duration {
+	return clk.Now().Sub(t)
+}
+
+// parseTime parses a SmugMug API timestamp in the clock's time zone.
+func parseTime(s string) (time.Time, error) {
+	return time.ParseInLocation(timeFormat, s, clk.Location())
+}
+
+// parseSince parses a -since value: a duration before now,
+// a date, or a date and time in the API's format.
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return clk.Now().Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, clk.Location()); err == nil {
+		return t, nil
+	}
+	if t, err := parseTime(s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a duration, date, or timestamp", s)
+}
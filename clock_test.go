@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFastSkip checks that -fast skips an album whose directory
+// timestamp matches its last update without listing its images, and
+// that a newer update brings the album back.
+func TestFastSkip(t *testing.T) {
+	f := newFakeSmug()
+	setup(t, f)
+	album := f.addAlbum("Travel", "Paris")
+	image := f.addImage(album, "IMG_0001.jpg", "JPG", []byte("tower"))
+
+	sync := func() {
+		t.Helper()
+		result := syncAccount(context.Background(), &account{provider: fakeAuth{f}})
+		if len(result.failures) > 0 {
+			t.Fatalf("failures: %v", result.failures)
+		}
+	}
+	sync()
+	if n := f.timesListed(album); n != 1 {
+		t.Fatalf("images listed %d times on the first sync, want 1", n)
+	}
+
+	sync()
+	if n := f.timesListed(album); n != 1 {
+		t.Errorf("images listed %d times after a matching sync, want 1", n)
+	}
+	if n := f.content.requests(image.OriginalURL); n != 1 {
+		t.Errorf("image downloaded %d times, want 1", n)
+	}
+
+	album.LastUpdated = "2020-02-03 04:05:06"
+	sync()
+	if n := f.timesListed(album); n != 2 {
+		t.Errorf("images listed %d times after an update, want 2", n)
+	}
+}
+
+// TestAlbumTimeout checks that -album-timeout measures from the clock.
+func TestAlbumTimeout(t *testing.T) {
+	f := newFakeSmug()
+	setup(t, f)
+	album := f.addAlbum("Travel", "Paris")
+	f.addImage(album, "IMG_0001.jpg", "JPG", []byte("tower"))
+	albumLimit = time.Hour
+
+	// with the clock a day behind, the deadline has already passed
+	clk = newFakeClock(time.Now().Add(-24 * time.Hour))
+	err := processAlbum(context.Background(), f, album, nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("processAlbum with an expired deadline = %v, want a time out", err)
+	}
+
+	clk = realClock{}
+	if err := processAlbum(context.Background(), f, album, nil); err != nil {
+		t.Errorf("processAlbum = %v", err)
+	}
+}
+
+func TestSince(t *testing.T) {
+	start := time.Date(2020, time.March, 4, 5, 6, 7, 0, time.UTC)
+	c := newFakeClock(start)
+	clk = c
+	defer func() { clk = realClock{} }()
+
+	if d := since(start); d != 0 {
+		t.Errorf("since(start) = %v before the clock moves, want 0", d)
+	}
+	c.Advance(90 * time.Second)
+	if d := since(start); d != 90*time.Second {
+		t.Errorf("since(start) = %v, want 1m30s", d)
+	}
+
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"36h", start.Add(90*time.Second - 36*time.Hour)},
+		{"2020-01-02", time.Date(2020, time.January, 2, 0, 0, 0, 0, time.UTC)},
+		{"2020-01-02 03:04:05", time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		got, err := parseSince(test.in)
+		if err != nil {
+			t.Errorf("parseSince(%q): %v", test.in, err)
+		} else if !got.Equal(test.want) {
+			t.Errorf("parseSince(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+	if _, err := parseSince("last week"); err == nil {
+		t.Errorf("parseSince(%q) succeeded", "last week")
+	}
+}
+
+// TestAlbumTimeNewestImage checks that -dir-time-from newest-image
+// passes over images without a usable date.
+func TestAlbumTimeNewestImage(t *testing.T) {
+	f := newFakeSmug()
+	setup(t, f)
+	dirTime = "newest-image"
+	album := f.addAlbum("Travel", "Paris")
+	dated := f.addImage(album, "IMG_0001.jpg", "JPG", []byte("tower"))
+	blank := f.addImage(album, "IMG_0002.jpg", "JPG", []byte("river"))
+	garbled := f.addImage(album, "IMG_0003.jpg", "JPG", []byte("bridge"))
+	dated.Date, blank.Date, garbled.Date = "2019-05-06 07:08:09", "", "sometime in May"
+
+	got, err := albumTime(album, fetchImages(context.Background(), f, album))
+	if err != nil {
+		t.Fatalf("albumTime: %v", err)
+	}
+	if want, _ := parseTime(dated.Date); !got.Equal(want) {
+		t.Errorf("albumTime = %v, want %v", got, want)
+	}
+
+	dated.Date = ""
+	got, err = albumTime(album, fetchImages(context.Background(), f, album))
+	if err != nil {
+		t.Fatalf("albumTime with no dated images: %v", err)
+	}
+	if want, _ := parseTime(album.LastUpdated); !got.Equal(want) {
+		t.Errorf("albumTime with no dated images = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fromEnv records the options that were set by environment variables.
+var fromEnv = make(map[string]bool)
+
+// loadJSONConfig reads a JSON object of option names to values and
+// applies each one that was not already given on the command line or
+// in the environment. It must be called after flag.Parse.
+// Unknown option names are an error so typos are caught.
+// Lists are applied one element at a time, for repeatable options.
+func loadJSONConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+	var options map[string]interface{}
+	if err := json.Unmarshal(data, &options); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return applyConfig(path, options)
+}
+
+// loadConfig reads a config file for -config. Files ending in .json
+// are handled by loadJSONConfig; anything else is read as simple TOML:
+// one "name = value" per line, where a value is a quoted string,
+// true or false, a number, or a list of quoted strings in brackets.
+// A missing file is only an error if required is set.
+func loadConfig(path string, required bool) error {
+	if strings.HasSuffix(path, ".json") {
+		if _, err := os.Stat(path); os.IsNotExist(err) && !required {
+			return nil
+		}
+		return loadJSONConfig(path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+	options := make(map[string]interface{})
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return fmt.Errorf("config file %s line %d: expected name = value", path, i+1)
+		}
+		name := strings.TrimSpace(line[:eq])
+		value, err := parseTOMLValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return fmt.Errorf("config file %s line %d: %v", path, i+1, err)
+		}
+		options[name] = value
+	}
+	return applyConfig(path, options)
+}
+
+// parseTOMLValue parses the value part of a config file line
+// into the types produced by encoding/json.
+func parseTOMLValue(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated list %s", s)
+		}
+		var list []interface{}
+		for _, elt := range strings.Split(s[1:len(s)-1], ",") {
+			elt = strings.TrimSpace(elt)
+			if elt == "" {
+				continue
+			}
+			v, err := strconv.Unquote(elt)
+			if err != nil {
+				return nil, fmt.Errorf("invalid list element %s", elt)
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'"):
+		if strings.HasPrefix(s, "'") && strings.HasSuffix(s, "'") && len(s) >= 2 {
+			// TOML literal strings have no escapes
+			return s[1 : len(s)-1], nil
+		}
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", s)
+		}
+		return v, nil
+	case s == "true" || s == "false":
+		return s == "true", nil
+	default:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %s", s)
+		}
+		return f, nil
+	}
+}
+
+// applyConfig applies options loaded from the config file at path.
+// Options already given on the command line or in the environment
+// (or by a config file loaded earlier) are left alone, so the first
+// file to set an option wins: -json-config is loaded before -config.
+func applyConfig(path string, options map[string]interface{}) error {
+	// find the options given on the command line (or set by another config file)
+	fromFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { fromFlags[f.Name] = true })
+
+	// apply them in a fixed order so errors are reproducible
+	var names []string
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var unknown []string
+	for _, name := range names {
+		if flag.Lookup(name) == nil {
+			unknown = append(unknown, name)
+			continue
+		}
+		if fromFlags[name] || fromEnv[name] {
+			continue
+		}
+		values, isList := options[name].([]interface{})
+		if !isList {
+			values = []interface{}{options[name]}
+		}
+		if list, ok := flag.Lookup(name).Value.(*listFlag); ok {
+			// the file replaces the default list instead of adding to it.
+			// A list from an earlier file was skipped above, since
+			// flag.Set marked it as given.
+			list.reset()
+		}
+		for _, value := range values {
+			var s string
+			switch v := value.(type) {
+			case string:
+				s = v
+			case bool:
+				s = strconv.FormatBool(v)
+			case float64:
+				s = strconv.FormatFloat(v, 'f', -1, 64)
+			default:
+				return fmt.Errorf("config file %s: unsupported value for %s: %v", path, name, value)
+			}
+			if err := flag.Set(name, s); err != nil {
+				return fmt.Errorf("config file %s: invalid value for %s: %v", path, name, err)
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("config file %s: unknown options: %s", path, strings.Join(unknown, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+// TestListFlagPrecedence checks that the command line replaces list
+// values from the environment, and repeated flags add to each other.
+func TestListFlagPrecedence(t *testing.T) {
+	var list stringList
+	list.Set("env-a,env-b")
+	fs := flag.NewFlagSet("smugsync", flag.ContinueOnError)
+	fs.Var(&listFlag{list: &list}, "include", "")
+
+	if err := fs.Parse([]string{"-include", "a,b", "-include", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := (stringList{"a", "b", "c"}); !reflect.DeepEqual(list, want) {
+		t.Errorf("list = %q, want %q", list, want)
+	}
+
+	// a config file replaces the list rather than adding to it
+	f := fs.Lookup("include").Value.(*listFlag)
+	f.reset()
+	fs.Set("include", "d")
+	if want := (stringList{"d"}); !reflect.DeepEqual(list, want) {
+		t.Errorf("list after reset = %q, want %q", list, want)
+	}
+}
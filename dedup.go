@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+
+	"github.com/russross/smugmug"
+)
+
+// dedupIndex maps MD5 sums to files in the target tree, for -dedup.
+// It is filled in as albums are scanned and files are downloaded,
+// so it only knows about albums this run has already reached.
+type dedupIndex struct {
+	sync.Mutex
+	paths map[string]string
+}
+
+var dedup = &dedupIndex{paths: make(map[string]string)}
+
+// add records that the file at path (relative to dir) has the given sum.
+func (d *dedupIndex) add(sum, path string) {
+	if dedupMode == "" || sum == "" {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	if _, present := d.paths[sum]; !present {
+		d.paths[sum] = path
+	}
+}
+
+// addAll records the local files of an album.
+func (d *dedupIndex) addAll(localFiles map[string]string) {
+	for path, sum := range localFiles {
+		if sum != "directory" {
+			d.add(sum, path)
+		}
+	}
+}
+
+func (d *dedupIndex) lookup(sum string) string {
+	d.Lock()
+	defer d.Unlock()
+	return d.paths[sum]
+}
+
+// linkDuplicate hard links fullpath to a file elsewhere in the tree
+// with the same contents as image, and returns that file's path
+// (relative to dir). It returns "" if there is no such file or the
+// link fails, in which case the image should be downloaded as usual.
+func linkDuplicate(path, fullpath string, image *smugmug.ImageInfo) string {
+	// video and resized rendition sums do not describe the files we download
+	if dedupMode != "hardlink" || isVideo(image.Format) || imageSize != "original" || image.MD5Sum == "" {
+		return ""
+	}
+	source := dedup.lookup(image.MD5Sum)
+	if source == "" || source == path {
+		return ""
+	}
+	info, err := store.Stat(filepath.Join(dir, source))
+	if err != nil || info.Size() != int64(image.Size) {
+		return ""
+	}
+
+	// link to a temporary name first so a failure leaves any old copy alone
+	if err := store.MkdirAll(filepath.Dir(fullpath)); err != nil {
+		return ""
+	}
+	tmp := fullpath + partSuffix
+	store.Remove(tmp)
+	if err := store.Link(filepath.Join(dir, source), tmp); err != nil {
+		log.Printf("    %s: unable to link to %s, downloading instead: %v", path, source, err)
+		return ""
+	}
+	if err := store.Rename(tmp, fullpath); err != nil {
+		store.Remove(tmp)
+		log.Printf("    %s: unable to link to %s, downloading instead: %v", path, source, err)
+		return ""
+	}
+	return source
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// dryRunPlan collects what a dry run would have done.
+type dryRunPlan struct {
+	sync.Mutex
+	newFiles      int
+	newBytes      int64
+	changedFiles  int
+	changedBytes  int64
+	deletedFiles  int
+	deletedDirs   int
+	skippedAlbums int
+	syncedAlbums  int
+}
+
+var plan dryRunPlan
+
+func (p *dryRunPlan) download(size int64, isNew bool) {
+	p.Lock()
+	defer p.Unlock()
+	if isNew {
+		p.newFiles++
+		p.newBytes += size
+	} else {
+		p.changedFiles++
+		p.changedBytes += size
+	}
+}
+
+func (p *dryRunPlan) remove(isDir bool) {
+	p.Lock()
+	defer p.Unlock()
+	if isDir {
+		p.deletedDirs++
+	} else {
+		p.deletedFiles++
+	}
+}
+
+func (p *dryRunPlan) album(skipped bool) {
+	p.Lock()
+	defer p.Unlock()
+	if skipped {
+		p.skippedAlbums++
+	} else {
+		p.syncedAlbums++
+	}
+}
+
+// report logs a summary of the plan.
+func (p *dryRunPlan) report() {
+	p.Lock()
+	defer p.Unlock()
+	log.Printf("Dry run summary:")
+	log.Printf("    %-24s %8d %12s", "new files", p.newFiles, formatSize(p.newBytes))
+	log.Printf("    %-24s %8d %12s", "changed files", p.changedFiles, formatSize(p.changedBytes))
+	log.Printf("    %-24s %8d", "files to delete", p.deletedFiles)
+	log.Printf("    %-24s %8d", "directories to delete", p.deletedDirs)
+	log.Printf("    %-24s %8d", "albums to sync", p.syncedAlbums)
+	log.Printf("    %-24s %8d", "albums skipped", p.skippedAlbums)
+}
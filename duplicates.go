@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/russross/smugmug"
+)
+
+// reportDuplicates lists the images that appear in more than one
+// album, for -report-duplicates. Images are matched by MD5 sum, or by
+// key for images with no sum. Nothing is downloaded.
+func reportDuplicates(c smugClient, albums []*smugmug.AlbumInfo) error {
+	type place struct {
+		album string
+		path  string
+	}
+	copies := make(map[string][]place)
+	for _, album := range albums {
+		images, err := fetchImages(context.Background(), c, album).wait()
+		if err != nil && isAccessError(err) {
+			skipInaccessible(album, err)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Images error in album %s: %v", album.URL, err)
+		}
+		paths, err := claimPaths(album, images)
+		if err != nil {
+			return err
+		}
+		for _, image := range images {
+			id := "md5 " + image.MD5Sum
+			if image.MD5Sum == "" {
+				id = "key " + image.Key
+			}
+			copies[id] = append(copies[id], place{album: album.URL, path: paths[image]})
+		}
+	}
+
+	var ids []string
+	for id, list := range copies {
+		albums := make(map[string]bool)
+		for _, elt := range list {
+			albums[elt.album] = true
+		}
+		if len(albums) > 1 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		log.Printf("Image with %s is in %d places:", id, len(copies[id]))
+		for _, elt := range copies[id] {
+			log.Printf("    %s [%s]", elt.path, elt.album)
+		}
+	}
+	log.Printf("Found %d images in more than one album", len(ids))
+	return nil
+}
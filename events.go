@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// event is a single line in the -events-file log.
+type event struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Album  string    `json:"album,omitempty"`
+	Path   string    `json:"path,omitempty"`
+	Bytes  int64     `json:"bytes,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+var (
+	eventsMutex sync.Mutex
+	eventsFP    *os.File
+)
+
+// openEvents opens the events file for appending.
+func openEvents(path string) error {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open events file %s: %v", path, err)
+	}
+	eventsFP = fp
+	return nil
+}
+
+// emit appends an event to the events file, if there is one.
+// Each event is written with a single write call so lines from
+// concurrent jobs are never interleaved.
+func emit(e event) {
+	if eventsFP == nil {
+		return
+	}
+	e.Time = clk.Now()
+	line, err := json.Marshal(e)
+	if err != nil {
+		logError(event{}, "error encoding event: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	if _, err := eventsFP.Write(line); err != nil {
+		logError(event{}, "error writing to events file: %v", err)
+	}
+}
+
+// closeEvents flushes and closes the events file.
+func closeEvents() {
+	if eventsFP == nil {
+		return
+	}
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	if err := eventsFP.Sync(); err != nil {
+		logError(event{}, "error flushing events file: %v", err)
+	}
+	eventsFP.Close()
+	eventsFP = nil
+}
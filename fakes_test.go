@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/russross/smugmug"
+)
+
+// fakeSmug is a SmugMug account held in memory. It must not be
+// changed once a sync has started.
+type fakeSmug struct {
+	sync.Mutex
+	albums  []*smugmug.AlbumInfo
+	images  map[*smugmug.AlbumInfo][]*smugmug.ImageInfo
+	listed  map[*smugmug.AlbumInfo]int
+	broken  map[*smugmug.AlbumInfo]error
+	nextID  int
+	content *fakeHTTP
+}
+
+func newFakeSmug() *fakeSmug {
+	return &fakeSmug{
+		images:  make(map[*smugmug.AlbumInfo][]*smugmug.ImageInfo),
+		listed:  make(map[*smugmug.AlbumInfo]int),
+		broken:  make(map[*smugmug.AlbumInfo]error),
+		content: &fakeHTTP{files: make(map[string][]byte), gets: make(map[string]int)},
+	}
+}
+
+func (f *fakeSmug) NickName() string { return "fake" }
+
+func (f *fakeSmug) Albums(nickName string) ([]*smugmug.AlbumInfo, error) {
+	return f.albums, nil
+}
+
+func (f *fakeSmug) Images(album *smugmug.AlbumInfo) ([]*smugmug.ImageInfo, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.listed[album]++
+	if err := f.broken[album]; err != nil {
+		return nil, err
+	}
+	return f.images[album], nil
+}
+
+// timesListed reports how many times an album's images were listed.
+func (f *fakeSmug) timesListed(album *smugmug.AlbumInfo) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.listed[album]
+}
+
+// addAlbum adds an album in the named category ("" for none).
+func (f *fakeSmug) addAlbum(category, title string) *smugmug.AlbumInfo {
+	f.nextID++
+	album := &smugmug.AlbumInfo{
+		ID:          f.nextID,
+		Key:         fmt.Sprintf("album%d", f.nextID),
+		Title:       title,
+		LastUpdated: "2020-01-02 03:04:05",
+		URL:         fmt.Sprintf("https://fake.smugmug.com/album%d", f.nextID),
+	}
+	if category != "" {
+		album.Category = &smugmug.CategoryInfo{Name: category}
+	}
+	f.albums = append(f.albums, album)
+	return album
+}
+
+// addImage adds an image with the given contents to an album
+// and serves the contents at the image's URL.
+func (f *fakeSmug) addImage(album *smugmug.AlbumInfo, name, format string, data []byte) *smugmug.ImageInfo {
+	f.nextID++
+	sum := md5.Sum(data)
+	image := &smugmug.ImageInfo{
+		ID:          f.nextID,
+		Key:         fmt.Sprintf("image%d", f.nextID),
+		FileName:    name,
+		Format:      format,
+		MD5Sum:      hex.EncodeToString(sum[:]),
+		Size:        len(data),
+		Date:        "2020-01-02 03:04:05",
+		LastUpdated: "2020-01-02 03:04:05",
+	}
+	url := "https://photos.fake/" + image.Key
+	if isVideo(format) {
+		image.Video320URL = url
+	} else {
+		image.OriginalURL = url
+	}
+	f.content.files[url] = data
+	f.images[album] = append(f.images[album], image)
+	album.ImageCount++
+	return image
+}
+
+// fakeAuth logs in to a fakeSmug.
+type fakeAuth struct {
+	c *fakeSmug
+}
+
+func (a fakeAuth) Login() (smugClient, error) { return a.c, nil }
+
+// fakeHTTP serves file contents by URL and counts the requests for each.
+type fakeHTTP struct {
+	sync.Mutex
+	files map[string][]byte
+	gets  map[string]int
+}
+
+func (f *fakeHTTP) Do(req *http.Request) (*http.Response, error) {
+	url := req.URL.String()
+	f.Lock()
+	data, present := f.files[url]
+	f.gets[url]++
+	f.Unlock()
+	if !present {
+		return &http.Response{StatusCode: http.StatusNotFound, Header: make(http.Header), Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+	var offset int
+	if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &offset); err == nil && offset <= len(data) {
+		return &http.Response{
+			StatusCode:    http.StatusPartialContent,
+			Header:        make(http.Header),
+			ContentLength: int64(len(data) - offset),
+			Body:          ioutil.NopCloser(bytes.NewReader(data[offset:])),
+		}, nil
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        make(http.Header),
+		ContentLength: int64(len(data)),
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+	}, nil
+}
+
+// requests returns the number of requests made for url.
+func (f *fakeHTTP) requests(url string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.gets[url]
+}
+
+// setup gives the settings their command-line defaults, points dir at
+// a new temporary directory, and serves downloads from f.
+func setup(t testing.TB, f *fakeSmug) {
+	dir = t.TempDir()
+	pauseDir = dir
+	dry, del, fast, newOnly, noClean = false, true, true, false, false
+	jobs, fileJobs, hashJobs, hashAlgo = 1, 1, runtime.NumCPU(), "md5"
+	videos, pics, videoRes, imageSize, resized = true, true, 0, "original", false
+	layout, pathTemplate, maxDepth, uncat, datedDirs = "category", nil, -1, "Uncategorized", false
+	order, prefetch, smart, progress, adaptive = "api-order", false, false, false, false
+	retries, timeout, verify, resume = 3, 30*time.Second, true, true
+	sizeLimit, minDate, maxDate = 0, time.Time{}, time.Time{}
+	dirTime, dirTimes, keepTimes, albumLimit = "album-updated", true, false, 0
+	keepOn, compact, verbosity = true, false, levelNormal
+	noCache, cache, metaHash, dedupMode, normalize = true, nil, false, "", false
+	captions, tags, imageMD, albumMD, sumsFile, manifest, emptyMarker = false, false, false, false, false, false, false
+	includes, excludes, named, ignores, category, sinceFlag = nil, nil, nil, nil, "", ""
+	parts, checkfs, touch, listOnly, reportDups, checkOnly, treeFile = "ignore", false, false, false, false, false, ""
+	ratio, deleteCount, deletePct, force, pruneDirs = 0, 0, 0, false, false
+	albumHook, syncHook, acctsFile = nil, nil, ""
+	overall, limiter, apiLimit, apiRetries = nil, nil, newAPILimiter(0), 5
+	owners = &pathOwners{keys: make(map[string]string)}
+	downloads, downloadHeader = context.Background(), make(http.Header)
+	clk = realClock{}
+	if f != nil {
+		httpClient = f.content
+	}
+	run = runStats{}
+}
+
+// writeFile creates a file under dir with the given contents.
+func writeFile(t testing.TB, path string, data []byte) {
+	fullpath := filepath.Join(dir, path)
+	if err := os.MkdirAll(filepath.Dir(fullpath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fullpath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFile returns the contents of a file under dir, or nil if it is missing.
+func readFile(t testing.TB, path string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join(dir, path))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// videoFormats maps the file formats SmugMug reports to whether each
+// one is a video. Add new formats here; -format-map adds to or
+// overrides the table at run time.
+var videoFormats = map[string]bool{
+	"MP4": true,
+	"AVI": true,
+	"MOV": true,
+
+	"JPG":  false,
+	"PNG":  false,
+	"GIF":  false,
+	"HEIC": false,
+	"TIFF": false,
+	"BMP":  false,
+	"WEBP": false,
+}
+
+// parseFormatMap applies -format-map entries of the form FORMAT=video
+// or FORMAT=picture to videoFormats.
+func parseFormatMap(list []string) error {
+	for _, elt := range list {
+		parts := strings.SplitN(elt, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("%q is not of the form FORMAT=video or FORMAT=picture", elt)
+		}
+		format := strings.ToUpper(strings.TrimSpace(parts[0]))
+		switch strings.TrimSpace(parts[1]) {
+		case "video":
+			videoFormats[format] = true
+		case "picture":
+			videoFormats[format] = false
+		default:
+			return fmt.Errorf("%q is not of the form FORMAT=video or FORMAT=picture", elt)
+		}
+	}
+	return nil
+}
+
+var (
+	unknownMutex   sync.Mutex
+	unknownFormats = make(map[string]bool)
+)
+
+// isVideo reports whether a file format is a video. Unknown formats
+// are treated as pictures, since the original upload can be downloaded
+// for any file, with a warning the first time each one is seen.
+func isVideo(format string) bool {
+	if video, known := videoFormats[format]; known {
+		return video
+	}
+
+	unknownMutex.Lock()
+	defer unknownMutex.Unlock()
+	if !unknownFormats[format] {
+		logWarn(event{}, "Warning: unknown image format %q, treating it as a picture", format)
+		unknownFormats[format] = true
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/russross/smugmug"
+)
+
+// freshListAge is how long a refreshed image list is trusted before
+// another refused download fetches it again.
+const freshListAge = time.Minute
+
+// freshURLs looks up current download URLs for an album's images.
+// The URLs in an image list can be signed and expire, which matters
+// when a long sync reaches an image long after the list was fetched.
+// The smugmug package cannot look up a single image, so the whole
+// list is fetched again, at most once per freshListAge.
+type freshURLs struct {
+	sync.Mutex
+	c       smugClient
+	album   *smugmug.AlbumInfo
+	images  []*smugmug.ImageInfo
+	fetched time.Time
+}
+
+// url returns a fresh download URL for image.
+func (f *freshURLs) url(image *smugmug.ImageInfo) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.images == nil || since(f.fetched) > freshListAge {
+		var images []*smugmug.ImageInfo
+		err := callWithRetry(context.Background(), f.album.Title, func() (err error) {
+			images, err = f.c.Images(f.album)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		f.images, f.fetched = images, clk.Now()
+	}
+	for _, elt := range f.images {
+		if elt.ID == image.ID && elt.Key == image.Key {
+			url, _, err := downloadURL(elt)
+			return url, err
+		}
+	}
+	return "", fmt.Errorf("image %s is no longer in the album", image.Key)
+}
+
+// isExpired reports whether a download error means the server refused
+// the URL, as it does when a signed URL has expired.
+func isExpired(err error) bool {
+	code := statusCode(err)
+	return code == http.StatusForbidden || code == http.StatusGone
+}
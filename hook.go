@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"text/template"
+)
+
+// hookFields are the values available to -post-album-hook and
+// -post-sync-hook. Files and Bytes count what was downloaded.
+type hookFields struct {
+	Album string // the album URL, empty for -post-sync-hook
+	Path  string // the album directory, or the target directory for -post-sync-hook
+	Files int64
+	Bytes int64
+}
+
+// hook is a command to run after an album or the whole sync. Each word
+// of the command is a Go text/template filled in with hookFields. The
+// command is run directly, not by a shell.
+type hook []*template.Template
+
+// albumHook and syncHook are nil when the flags are not set.
+var albumHook, syncHook hook
+
+// parseHook parses a hook command and tries it out on sample values,
+// so mistakes are reported before any work is done.
+func parseHook(s string) (hook, error) {
+	var h hook
+	for _, word := range strings.Fields(s) {
+		tmpl, err := template.New("hook").Option("missingkey=error").Parse(word)
+		if err != nil {
+			return nil, err
+		}
+		h = append(h, tmpl)
+	}
+	if len(h) == 0 {
+		return nil, fmt.Errorf("no command given")
+	}
+	if _, err := h.args(&hookFields{Album: "https://example.smugmug.com/album", Path: "Category/Album"}); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h hook) args(fields *hookFields) ([]string, error) {
+	var args []string
+	for _, tmpl := range h {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, fields); err != nil {
+			return nil, err
+		}
+		args = append(args, buf.String())
+	}
+	return args, nil
+}
+
+// run runs the hook, logging its output. name identifies the hook in
+// the log. It does nothing if the hook is not set.
+func (h hook) run(name string, fields *hookFields) error {
+	if h == nil {
+		return nil
+	}
+	args, err := h.args(fields)
+	if err != nil {
+		return fmt.Errorf("error filling in %s: %v", name, err)
+	}
+	if dry {
+		log.Printf("dry run, not running %s: %s", name, strings.Join(args, " "))
+		return nil
+	}
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		if line != "" {
+			log.Printf("    %s: %s", name, line)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// ignoreName is a file listing patterns of local files that smugsync
+// should leave alone, one per line. It applies to the directory it is
+// in and everything below it.
+const ignoreName = ".smugsyncignore"
+
+// readIgnoreFile returns the patterns in the ignore file in dirpath, if
+// any. Malformed patterns are reported and left out, since they could
+// never match.
+func readIgnoreFile(dirpath string) []string {
+	name := filepath.Join(dirpath, ignoreName)
+	data, err := store.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+	var patterns []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := filepath.Match(line, ""); err != nil {
+			logWarn(event{Path: name}, "Warning: ignoring invalid pattern %q on line %d of %s: %v", line, i+1, name, err)
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns
+}
+
+// isIgnored reports whether a local file should be left alone.
+// Patterns are matched against the file's name and against its path
+// relative to the album directory. The ignore files themselves are
+// always ignored.
+func isIgnored(rel string, patterns []string) bool {
+	name := filepath.Base(rel)
+	if name == ignoreName {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, rel); matched {
+			return true
+		}
+	}
+	return false
+}
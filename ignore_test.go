@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIsIgnored(t *testing.T) {
+	patterns := []string{"*.xmp", "edits/*", "Thumbs.db"}
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"IMG_0001.xmp", true},
+		{"edits/IMG_0001.jpg", true},
+		{"nested/Thumbs.db", true},
+		{ignoreName, true},
+		{"nested/" + ignoreName, true},
+		{"IMG_0001.jpg", false},
+		{"nested/edits/IMG_0001.jpg", false},
+	}
+	for _, test := range tests {
+		if got := isIgnored(test.rel, patterns); got != test.want {
+			t.Errorf("isIgnored(%q) = %v, want %v", test.rel, got, test.want)
+		}
+	}
+}
+
+// TestReadIgnoreFile checks that comments, blank lines, and malformed
+// patterns are left out of an ignore file.
+func TestReadIgnoreFile(t *testing.T) {
+	setup(t, nil)
+	writeFile(t, ignoreName, []byte("# sidecars\n*.xmp\n\n[unclosed\n  edits/*  \n"))
+	got := readIgnoreFile(dir)
+	if want := []string{"*.xmp", "edits/*"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("readIgnoreFile = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// lockName is the file in the target directory that is locked
+// while smugsync runs, so two runs cannot work on it at once.
+const lockName = ".smugsync.lock"
+
+var lockFP *os.File
+
+// acquireLock locks the lock file in dirpath, failing if another
+// smugsync holds it. With -force, a lock left behind is taken over.
+func acquireLock(dirpath string) error {
+	name := filepath.Join(dirpath, lockName)
+	fp, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file %s: %v", name, err)
+	}
+	if err := lockFile(fp, name); err != nil {
+		fp.Close()
+		return err
+	}
+	fp.Truncate(0)
+	fp.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	lockFP = fp
+	return nil
+}
+
+// releaseLock unlocks the lock file, if we hold it. The file is left
+// in place: removing it would let a run that opened it before the
+// unlock hold a lock on a file that a third run no longer sees. It is
+// emptied instead, since on Windows a process ID in it means held.
+func releaseLock() {
+	if lockFP == nil {
+		return
+	}
+	lockFP.Truncate(0)
+	unlockFile(lockFP)
+	lockFP.Close()
+	lockFP = nil
+}
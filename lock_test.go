@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// TestLockReleasedOnFailure checks that an account that fails before
+// syncing returns to main, which releases the lock, and that the lock
+// can then be taken again.
+func TestLockReleasedOnFailure(t *testing.T) {
+	f := newFakeSmug()
+	setup(t, f)
+	if err := acquireLock(dir); err != nil {
+		t.Fatal(err)
+	}
+	sinceFlag = "last week"
+	result := syncAccount(context.Background(), &account{provider: fakeAuth{f}})
+	if len(result.failures) != 1 || !strings.Contains(result.failures[0], "Invalid -since") {
+		t.Errorf("failures = %q, want an invalid -since", result.failures)
+	}
+
+	releaseLock()
+	if err := acquireLock(dir); err != nil {
+		t.Errorf("lock not released: %v", err)
+	}
+	releaseLock()
+}
+
+// TestLockTwice checks that the lock can be taken again after each
+// release, and that releasing it leaves no process ID behind for
+// lockFile to mistake for a running smugsync on Windows.
+func TestLockTwice(t *testing.T) {
+	setup(t, nil)
+	for i := 0; i < 2; i++ {
+		if err := acquireLock(dir); err != nil {
+			t.Fatalf("acquire %d: %v", i+1, err)
+		}
+		releaseLock()
+		if pid := readFile(t, lockName); len(pid) != 0 {
+			t.Fatalf("lock file holds %q after release", pid)
+		}
+	}
+}
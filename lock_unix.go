@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// lockFile takes an advisory lock on fp. The operating system
+// releases it if smugsync dies, so a lock is never left stale.
+func lockFile(fp *os.File, name string) error {
+	if err := syscall.Flock(int(fp.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			pid, _ := ioutil.ReadFile(name)
+			return fmt.Errorf("another smugsync (pid %s) is already running in this directory", strings.TrimSpace(string(pid)))
+		}
+		return fmt.Errorf("failed to lock %s: %v", name, err)
+	}
+	return nil
+}
+
+func unlockFile(fp *os.File) {
+	syscall.Flock(int(fp.Fd()), syscall.LOCK_UN)
+}
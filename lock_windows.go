@@ -0,0 +1,24 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// lockFile treats a lock file with a process ID in it as held, since
+// there is no advisory locking to rely on. A lock left behind by a
+// run that crashed must be taken over with -force.
+func lockFile(fp *os.File, name string) error {
+	pid, _ := ioutil.ReadAll(fp)
+	if owner := strings.TrimSpace(string(pid)); owner != "" && !force {
+		return fmt.Errorf("another smugsync (pid %s) may be running in this directory (use -force if it is not)", owner)
+	}
+	return nil
+}
+
+func unlockFile(fp *os.File) {}
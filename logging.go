@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// jsonLog is set by -log-format json.
+var jsonLog bool
+
+var jsonLogMutex sync.Mutex
+
+// jsonLogLine is one line of JSON log output. The fields of the
+// event (if any) are included at the top level.
+type jsonLogLine struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	event
+}
+
+// Levels reported in JSON log lines.
+const (
+	levelInfo    = "info"
+	levelWarning = "warning"
+	levelError   = "error"
+)
+
+func writeJSONLog(level, msg string, e event) {
+	msg = strings.TrimSpace(msg)
+	e.Time = clk.Now()
+	line, err := json.Marshal(&jsonLogLine{Level: level, Message: msg, event: e})
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"level":"error","message":%q}`, "error encoding log line: "+err.Error()))
+	}
+	jsonLogMutex.Lock()
+	defer jsonLogMutex.Unlock()
+	os.Stderr.Write(append(line, '\n'))
+}
+
+// jsonLogWriter turns plain log.Printf output into JSON lines.
+// Warnings and errors go through logWarn and logError instead,
+// so everything written here is informational.
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(p []byte) (int, error) {
+	writeJSONLog(levelInfo, string(p), event{})
+	return len(p), nil
+}
+
+// setupLogging switches the standard logger to JSON output if requested.
+func setupLogging(format string) error {
+	switch format {
+	case "text":
+	case "json":
+		jsonLog = true
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{})
+	default:
+		return fmt.Errorf("unknown log format %q: must be text or json", format)
+	}
+	return nil
+}
+
+// Log levels, chosen with -quiet and -verbose.
+const (
+	levelQuiet   = iota // warnings, errors, and the final summary
+	levelNormal         // album-level activity, downloads, and deletions
+	levelVerbose        // everything, including each skipped file
+)
+
+var verbosity = levelNormal
+
+// logAt is like logEvent, but only logs at the given level or above.
+func logAt(level int, e event, format string, args ...interface{}) {
+	if verbosity < level {
+		return
+	}
+	logEvent(e, format, args...)
+}
+
+// logEvent logs a message about an action. In JSON format, the
+// details of the action from e are included as structured fields.
+func logEvent(e event, format string, args ...interface{}) {
+	logWithLevel(levelInfo, e, format, args...)
+}
+
+// logWarn is like logEvent for a problem that smugsync works around.
+func logWarn(e event, format string, args ...interface{}) {
+	logWithLevel(levelWarning, e, format, args...)
+}
+
+// logError is like logEvent for a failure.
+func logError(e event, format string, args ...interface{}) {
+	logWithLevel(levelError, e, format, args...)
+}
+
+// fatalf is like log.Fatalf, but in JSON format the message is
+// reported at the error level.
+func fatalf(format string, args ...interface{}) {
+	logError(event{}, format, args...)
+	os.Exit(1)
+}
+
+func logWithLevel(level string, e event, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !jsonLog {
+		log.Print(msg)
+		return
+	}
+	writeJSONLog(level, msg, e)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestJSONLogLevels checks that the level of a JSON log line comes
+// from the call, not from the wording of the message.
+func TestJSONLogLevels(t *testing.T) {
+	setup(t, nil)
+	out, err := os.Create(filepath.Join(t.TempDir(), "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stderr := os.Stderr
+	os.Stderr, jsonLog = out, true
+	defer func() { os.Stderr, jsonLog = stderr, false }()
+
+	logEvent(event{}, "Errors in EXIF data are ignored")
+	logWarn(event{}, "    error downloading %s, retrying", "a.jpg")
+	logError(event{Event: "error"}, "Login error: %v", "denied")
+	jsonLogWriter{}.Write([]byte("Warning signs are not warnings\n"))
+
+	data, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{levelInfo, levelWarning, levelError, levelInfo}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %d log lines, want %d:\n%s", len(lines), len(want), data)
+	}
+	for i, line := range lines {
+		var got jsonLogLine
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		if got.Level != want[i] {
+			t.Errorf("%q logged at level %s, want %s", got.Message, got.Level, want[i])
+		}
+	}
+}
+
+// TestCompactVerbose checks that -verbose logs skipped files even
+// with -compact-log.
+func TestCompactVerbose(t *testing.T) {
+	f := newFakeSmug()
+	setup(t, f)
+	album := f.addAlbum("Travel", "Paris")
+	image := f.addImage(album, "IMG_0001.jpg", "JPG", []byte("tower"))
+	path := "Travel/Paris/IMG_0001.jpg"
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		compact bool
+		level   int
+		logged  bool
+	}{
+		{false, levelNormal, false},
+		{false, levelVerbose, true},
+		{true, levelNormal, false},
+		{true, levelVerbose, true},
+	}
+	for _, test := range tests {
+		compact, verbosity = test.compact, test.level
+		out.Reset()
+		localFiles := map[string]string{path: image.MD5Sum}
+		checkFile(album, image, path, localFiles, &albumStats{sums: make(map[string]string)})
+		if logged := strings.Contains(out.String(), "skipping unchanged file"); logged != test.logged {
+			t.Errorf("compact %v, verbosity %d: logged skip = %v, want %v", test.compact, test.level, logged, test.logged)
+		}
+	}
+}
@@ -1,321 +1,2138 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	pathpkg "path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/russross/smugmug"
 )
 
+// timeFormat is the layout of timestamps in the SmugMug API.
+const timeFormat = "2006-01-02 15:04:05"
+
+// version is reported in the default User-Agent.
+const version = "1.0"
+
 var (
-	apiKey   string
-	email    string
-	password string
-	dir      string
-	dry      bool
-	del      bool
-	fast     bool
-	jobs     int
-	videos   bool
-	pics     bool
-
-	fileCount  int
-	totalBytes int
+	apiKey      string
+	auth        string
+	email       string
+	password    string
+	dir         string
+	dry         bool
+	del         bool
+	fast        bool
+	jobs        int
+	videos      bool
+	pics        bool
+	picsOnly    bool
+	vidsOnly    bool
+	touch       bool
+	checkfs     bool
+	order       string
+	prefetch    bool
+	events      string
+	statsFile   string
+	treeFile    string
+	albumCmd    string
+	syncCmd     string
+	hookFatal   bool
+	acctsFile   string
+	resized     bool
+	compact     bool
+	maxDepth    int
+	parts       string
+	albumMD     bool
+	emptyMarker bool
+	retries     int
+	uncat       string
+	smart       bool
+	noClean     bool
+	newOnly     bool
+	ratio       float64
+	maxDelete   string
+	deleteCount int
+	deletePct   float64
+	force       bool
+	dirTime     string
+	category    string
+	sumsFile    bool
+	manifest    bool
+	jsonConf    string
+	confFile    string
+	includes    stringList
+	excludes    stringList
+	named       stringList
+	ignores     stringList
+	headers     stringList
+	formatMap   stringList
+	userAgent   string
+	captions    bool
+	tags        bool
+	metaHash    bool
+	progress    bool
+	verify      bool
+	maxRate     string
+	apiRate     float64
+	apiRetries  int
+	maxFileSize string
+	sizeLimit   int64
+	imageMD     bool
+	sinceFlag   string
+	minDateFlag string
+	maxDateFlag string
+	minDate     time.Time
+	maxDate     time.Time
+	logFormat   string
+	verbose     bool
+	quiet       bool
+	keepTimes   bool
+	dirTimes    bool
+	videoRes    int
+	imageSize   string
+	layout      string
+	pathTmpl    string
+	dedupMode   string
+	pruneDirs   bool
+	reportDups  bool
+	listOnly    bool
+	checkOnly   bool
+	normalize   bool
+	datedDirs   bool
+	resume      bool
+	keepOn      bool
+	noCache     bool
+	fileJobs    int
+	adaptive    bool
+	maxConns    int
+	hashJobs    int
+	hashAlgo    string
+	timeout     time.Duration
+	albumLimit  time.Duration
+	dialTime    time.Duration
+
+	// updated with sync/atomic, since downloads run concurrently
+	fileCount  int64
+	totalBytes int64
 )
 
-func main() {
-	start := time.Now()
+func main() {
+	start := clk.Now()
+
+	// parse config
+	configString(&logFormat, "log-format", "text", "Log format: text or json")
+	configString(&jsonConf, "json-config", "", "JSON file of option names and values; its values take priority over -config, which also reads JSON from files named *.json")
+	configString(&confFile, "config", defaultConfigFile(), "Config file of option names and values (TOML, or JSON if named *.json)")
+	configString(&apiKey, "apikey", "", "SmugMug API key")
+	configString(&email, "email", "", "Email address")
+	configString(&password, "password", "", "Password")
+	configString(&auth, "auth", "password", "Authentication method: password")
+	configString(&dir, "dir", "", "Target directory")
+	configBool(&checkOnly, "check", false, "Instead of syncing, check local files against the server and report missing, extra, and corrupted files")
+	configBool(&listOnly, "list", false, "Instead of syncing, list the albums that would be synced (after filtering)")
+	configBool(&reportDups, "report-duplicates", false, "Instead of syncing, list images that appear in more than one album")
+	configBool(&pruneDirs, "prune-empty-dirs", false, "After syncing, remove empty directories that do not belong to an album")
+	configString(&dedupMode, "dedup", "", "Set to hardlink to link files that are identical to one already synced instead of downloading them again")
+	configString(&sanitizeReplacement, "sanitize-replacement", "_", "Replacement for characters that are not allowed in file names")
+	configBool(&datedDirs, "dir-per-date", false, "Group the files in each album directory into YYYY-MM subdirectories by date taken")
+	configBool(&normalize, "normalize-unicode", runtime.GOOS == "darwin", "Match local file names to the server's even if their Unicode normalization (NFC or NFD) differs")
+	configString(&pathTmpl, "path-template", "", "Go text/template for each file's path, using .Category, .SubCategory, .Title, .FileName, .DateTaken, and .Key; turns off -delete, -fast, and -dir-times")
+	configString(&layout, "layout", "category", "Directory layout: category (Category/SubCategory/Album/file), flat (all files in one directory), or date (YYYY/MM/file); flat and date turn off -delete, -fast, and -dir-times")
+	configList(&includes, "include", "Only sync albums whose Category/SubCategory/Title matches this glob (comma-separated or repeated)")
+	configList(&excludes, "exclude", "Skip albums whose Category/SubCategory/Title matches this glob (comma-separated or repeated)")
+	configList(&named, "album", "Only sync the album with this URL, key, or ID, ignoring other album filters (comma-separated or repeated)")
+	configList(&ignores, "ignore", "Never delete local files whose name or path within the album matches this glob (comma-separated or repeated)")
+	configString(&minDateFlag, "min-date", "", "Only sync images taken on or after this date (2006-01-02); images with no date taken are always synced")
+	configString(&maxDateFlag, "max-date", "", "Only sync images taken on or before this date (2006-01-02); images with no date taken are always synced")
+	configString(&sinceFlag, "since", "", "Only sync albums updated since this date (2006-01-02) or this long ago (e.g., 168h)")
+	configString(&category, "category", "", "Only sync albums in this category (use Category/SubCategory for a subcategory)")
+	configBool(&dry, "dry", false, "Dry run (no changes)")
+	configBool(&verbose, "verbose", false, "Log every file, including skipped files and each file a dry run would change")
+	configBool(&quiet, "quiet", false, "Only log warnings, errors, and the final summary")
+	configBool(&del, "delete", true, "Delete local files not in album")
+	configBool(&newOnly, "new-only", false, "Only download files that do not exist locally, without hashing existing files or cleaning up (server-side edits are not detected)")
+	configBool(&noClean, "no-cleanup", false, "Skip the cleanup phase entirely (no deleting or accounting of extra local files)")
+	configFloat(&ratio, "ratio-guard", 0, "Skip cleanup of an album if it would delete more than this fraction of its local files (0 to disable)")
+	configString(&maxDelete, "max-delete", "", "Skip cleanup of an album if it would delete more than this many files, or this percentage of its local files, e.g., 100 or 25% or 100,25%")
+	configBool(&force, "force", false, "Override safety checks that prevent deleting files, and take over a lock left by a crashed run")
+	configString(&dirTime, "dir-time-from", "album-updated", "Source of album directory timestamps: album-updated or newest-image")
+	configBool(&dirTimes, "dir-times", true, "Set album directory timestamps (required for -fast to skip albums)")
+	configBool(&keepTimes, "preserve-times", false, "Set each downloaded file's timestamp to the image's date")
+	configBool(&fast, "fast", true, "Skip albums with timestamp match")
+	configBool(&videos, "videos", true, "Download videos")
+	configBool(&pics, "pics", true, "Download pictures")
+	configInt(&videoRes, "video-res", 0, "Largest video resolution to download, e.g., 1280 (0 for the highest available)")
+	configString(&imageSize, "image-size", "original", "Size of pictures to download: original, x3large, x2large, xlarge, large, medium, or small")
+	configBool(&picsOnly, "pics-only", false, "Download pictures but not videos")
+	configBool(&vidsOnly, "videos-only", false, "Download videos but not pictures")
+	configBool(&keepOn, "keep-going", true, "Keep processing other albums after an album fails")
+	configInt(&jobs, "jobs", 1, "Number of concurrent jobs to run")
+	configInt(&fileJobs, "download-jobs", 1, "Number of concurrent downloads within each album")
+	configBool(&adaptive, "adaptive-jobs", false, "Process fewer albums at once when SmugMug throttles requests, ramping back up to -jobs as requests succeed")
+	configInt(&maxConns, "max-conns", 0, "Most HTTP connections to open to any one host (0 for -jobs times -download-jobs)")
+	configInt(&hashJobs, "hash-jobs", runtime.NumCPU(), "Number of local files to hash at once when scanning an album directory")
+	configString(&hashAlgo, "hash-algo", "md5", "Digest to record for local files in the cache and manifest: md5 or sha256 (MD5 is always used to compare with SmugMug)")
+	configString(&order, "download-order", "api-order", "Order to download images within an album: small-first, large-first, or api-order")
+	configBool(&prefetch, "prefetch", false, "List the next album's images while the current album downloads")
+	configString(&events, "events-file", "", "Append NDJSON events for each action to this file")
+	configString(&acctsFile, "accounts", "", "JSON file listing several accounts to sync, each into its own subdirectory")
+	configString(&statsFile, "stats", "", "Write a JSON summary of the run to this file")
+	configString(&albumCmd, "post-album-hook", "", "Command to run after each album is synced; words may use {{.Album}}, {{.Path}}, {{.Files}}, and {{.Bytes}}")
+	configString(&syncCmd, "post-sync-hook", "", "Command to run after the whole sync; words may use {{.Path}}, {{.Files}}, and {{.Bytes}}")
+	configBool(&hookFatal, "hook-errors-fatal", false, "Treat a failed hook command as a failure of the album or sync instead of a warning")
+	configString(&treeFile, "dump-tree", "", "Before syncing, write every selected album and its images to this JSON file")
+	configBool(&resized, "resized", false, "Download the largest resized rendition when the original is unavailable (these are re-downloaded every run)")
+	configBool(&compact, "compact-log", false, "Log a summary line per album instead of each skipped file")
+	configInt(&maxDepth, "max-depth", -1, "Number of category levels to create above album directories (-1 for all)")
+	configString(&parts, "part-files", "ignore", "What to do with leftover partial downloads: ignore, report, or remove (the ones that cannot be resumed)")
+	configBool(&captions, "captions", false, "Save each image's caption in a .txt file next to the image")
+	configBool(&tags, "tags", false, "Save each image's keywords in a .tags file next to the image, one per line")
+	configBool(&metaHash, "include-metadata-in-hash", false, "Track each image's caption, keywords, and date in the MD5 cache, and refresh unchanged files when they change")
+	configBool(&imageMD, "metadata", false, "Save each image's full details in a .json file next to the image")
+	configBool(&albumMD, "album-metadata", false, "Write album details to album.json in each album directory")
+	configBool(&emptyMarker, "empty-album-marker", false, "Create a directory with a .empty marker file for albums that have no images")
+	configBool(&verify, "verify", true, "Check the MD5 sum of each downloaded picture against the server")
+	configBool(&resume, "resume", true, "Resume partial downloads using HTTP Range requests")
+	configDuration(&timeout, "timeout", 30*time.Second, "Give up on a download if the server sends nothing for this long")
+	configDuration(&dialTime, "dial-timeout", 10*time.Second, "Timeout for connecting to the server")
+	configDuration(&albumLimit, "album-timeout", 0, "Give up on an album that takes longer than this to sync (0 for no limit)")
+	configString(&maxRate, "max-rate", "0", "Limit total download rate, e.g., 5MB/s (0 for unlimited)")
+	configInt(&apiRetries, "api-retries", 5, "Number of times to retry an API call that fails with a timeout, throttling, or server error")
+	configFloat(&apiRate, "api-rate", 0, "Limit SmugMug API calls to this many per second across all jobs (0 for unlimited)")
+	configString(&userAgent, "user-agent", "smugsync/"+version, "User-Agent header for downloads")
+	configList(&formatMap, "format-map", "Treat a file format as a video or picture, as FORMAT=video or FORMAT=picture (comma-separated or repeated)")
+	configList(&headers, "header", "Extra header for downloads, as Name: value (repeated)")
+	configString(&maxFileSize, "max-filesize", "0", "Skip files larger than this, e.g., 500MB (0 for unlimited)")
+	configInt(&retries, "retries", 3, "Number of times to retry a failed or incomplete download")
+	configString(&uncat, "uncategorized", "Uncategorized", "Directory for albums that are not in a category")
+	configBool(&smart, "smart-schedule", false, "Process albums with the most images (with -progress, the most bytes) first so concurrent jobs finish together")
+	configBool(&sumsFile, "checksums", false, "Write an md5sum-compatible .md5sums file in each album directory")
+	configBool(&manifest, "manifest", false, "Write an index.json listing every image's name, size, MD5 sum, and key in each album directory")
+	configBool(&noCache, "no-cache", false, "Hash every local file instead of using cached MD5 sums")
+	configBool(&progress, "progress", false, "Log overall progress, and progress of large downloads when there is one job writing to a terminal; lists every album up front and holds the lists in memory, so -fast no longer saves listing albums")
+	configBool(&checkfs, "check-fs", false, "Check that the target filesystem supports the selected options before syncing")
+	configBool(&touch, "touch-only", false, "Only set album directory timestamps (no downloading or deleting)")
+	flag.Parse()
+	if flag.NArg() != 0 {
+		fatalf("Unknown command-line options: %s", strings.Join(flag.Args(), " "))
+	}
+	if jsonConf != "" {
+		if err := loadJSONConfig(jsonConf); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	if confFile != "" {
+		if err := loadConfig(confFile, confFile != defaultConfigFile()); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	if err := setupLogging(logFormat); err != nil {
+		fatalf("%v", err)
+	}
+	if fileJobs < 1 {
+		fatalf("-download-jobs must be at least 1")
+	}
+	if maxConns < 0 {
+		fatalf("-max-conns must not be negative")
+	}
+	if maxConns == 0 {
+		maxConns = jobs * fileJobs
+	}
+	if count, pct, err := parseMaxDelete(maxDelete); err != nil {
+		fatalf("Invalid -max-delete: %v", err)
+	} else {
+		deleteCount, deletePct = count, pct
+	}
+	if newOnly {
+		if sumsFile {
+			fatalf("-new-only cannot be used with -checksums")
+		}
+		noClean = true
+		log.Printf("-new-only: existing files are assumed unchanged and nothing is deleted")
+	}
+	if metaHash && noCache {
+		fatalf("-include-metadata-in-hash needs the MD5 cache, so it cannot be used with -no-cache")
+	}
+	if _, ok := imageSizes[imageSize]; !ok && imageSize != "original" {
+		fatalf("Unknown image size %q: must be original, x3large, x2large, xlarge, large, medium, or small", imageSize)
+	}
+	// the reporting modes change nothing, so treat them like a dry run
+	if listOnly || reportDups || checkOnly {
+		dry = true
+	}
+	if hashJobs < 1 {
+		fatalf("-hash-jobs must be at least 1")
+	}
+	if hashAlgo != "md5" && hashAlgo != "sha256" {
+		fatalf("Unknown hash algorithm %q: must be md5 or sha256", hashAlgo)
+	}
+	if timeout <= 0 || dialTime <= 0 {
+		fatalf("-timeout and -dial-timeout must be positive")
+	}
+	httpClient = newHTTPClient(timeout, dialTime)
+	if header, err := parseHeaders(headers); err != nil {
+		fatalf("Invalid -header: %v", err)
+	} else {
+		downloadHeader = header
+	}
+	if err := parseFormatMap(formatMap); err != nil {
+		fatalf("Invalid -format-map: %v", err)
+	}
+	if albumCmd != "" {
+		if h, err := parseHook(albumCmd); err != nil {
+			fatalf("Invalid -post-album-hook: %v", err)
+		} else {
+			albumHook = h
+		}
+	}
+	if syncCmd != "" {
+		if h, err := parseHook(syncCmd); err != nil {
+			fatalf("Invalid -post-sync-hook: %v", err)
+		} else {
+			syncHook = h
+		}
+	}
+	if userAgent != "" {
+		downloadHeader.Set("User-Agent", userAgent)
+	}
+	if rate, err := parseRate(maxRate); err != nil {
+		fatalf("Invalid -max-rate: %v", err)
+	} else if rate > 0 {
+		limiter = newRateLimiter(rate)
+	}
+	if apiRate < 0 || apiRetries < 0 {
+		fatalf("-api-rate and -api-retries cannot be negative")
+	}
+	apiLimit = newAPILimiter(apiRate)
+	if limit, err := parseSize(maxFileSize); err != nil {
+		fatalf("Invalid -max-filesize: %v", err)
+	} else {
+		sizeLimit = limit
+	}
+	if minDateFlag != "" {
+		if t, err := time.ParseInLocation("2006-01-02", minDateFlag, clk.Location()); err != nil {
+			fatalf("Invalid -min-date: %v", err)
+		} else {
+			minDate = t
+		}
+	}
+	if maxDateFlag != "" {
+		if t, err := time.ParseInLocation("2006-01-02", maxDateFlag, clk.Location()); err != nil {
+			fatalf("Invalid -max-date: %v", err)
+		} else {
+			// include the whole day
+			maxDate = t.AddDate(0, 0, 1)
+		}
+	}
+	for _, pattern := range append(includes, excludes...) {
+		if _, err := pathpkg.Match(pattern, ""); err != nil {
+			fatalf("Invalid pattern %q: %v", pattern, err)
+		}
+	}
+	for _, pattern := range ignores {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			fatalf("Invalid -ignore pattern %q: %v", pattern, err)
+		}
+	}
+	switch {
+	case quiet && verbose:
+		fatalf("-quiet and -verbose cannot be used together")
+	case quiet:
+		verbosity = levelQuiet
+	case verbose:
+		verbosity = levelVerbose
+	}
+	if picsOnly && vidsOnly {
+		fatalf("-pics-only and -videos-only cannot be used together")
+	}
+	if picsOnly {
+		pics, videos = true, false
+	}
+	if vidsOnly {
+		pics, videos = false, true
+	}
+	accounts := []*account{{Email: email, Password: password, APIKey: apiKey}}
+	var err error
+	if acctsFile != "" {
+		if accounts, err = loadAccounts(acctsFile); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	for _, a := range accounts {
+		a.use()
+		if apiKey == "" {
+			fatalf("apikey is required")
+		}
+		if a.provider, err = getAuthProvider(auth); err != nil {
+			fatalf("Auth error: %v", err)
+		}
+	}
+	switch parts {
+	case "ignore", "report", "remove":
+	default:
+		fatalf("Unknown part-files action %q: must be ignore, report, or remove", parts)
+	}
+	if dedupMode != "" && dedupMode != "hardlink" {
+		fatalf("Unknown dedup mode %q: must be hardlink", dedupMode)
+	}
+	if sanitizeReplacement == "" || sanitizeName(sanitizeReplacement) != sanitizeReplacement {
+		fatalf("Invalid -sanitize-replacement %q: it must be allowed in file names", sanitizeReplacement)
+	}
+	switch layout {
+	case "category", "flat", "date":
+	default:
+		fatalf("Unknown layout %q: must be category, flat, or date", layout)
+	}
+	if pathTmpl != "" {
+		if layout != "category" {
+			fatalf("-path-template cannot be used with -layout %s", layout)
+		}
+		if pathTemplate, err = parsePathTemplate(pathTmpl); err != nil {
+			fatalf("Invalid -path-template: %v", err)
+		}
+	}
+	if datedDirs && !albumDirs() {
+		fatalf("-dir-per-date can only be used with -layout category and no -path-template")
+	}
+	if !albumDirs() && (sumsFile || albumMD || manifest || emptyMarker) {
+		fatalf("-checksums, -album-metadata, -manifest, and -empty-album-marker require -layout category and no -path-template")
+	}
+	if !albumDirs() {
+		// these are on by default but cannot work when albums share
+		// directories, so only asking for them is an error
+		given := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+		for _, opt := range []struct {
+			name string
+			on   bool
+		}{{"delete", del}, {"fast", fast}, {"dir-times", dirTimes}} {
+			if opt.on && (given[opt.name] || fromEnv[opt.name]) {
+				fatalf("-%s cannot be used with -layout flat or date or with -path-template", opt.name)
+			}
+		}
+	}
+	switch dirTime {
+	case "album-updated", "newest-image":
+	default:
+		fatalf("Unknown directory time source %q: must be album-updated or newest-image", dirTime)
+	}
+	switch order {
+	case "small-first", "large-first", "api-order":
+	default:
+		fatalf("Unknown download order %q: must be small-first, large-first, or api-order", order)
+	}
+	if dir == "" {
+		dir = "."
+	}
+	d, err := filepath.Abs(dir)
+	if err != nil {
+		fatalf("Unable to find absolute path for %s: %v", dir, err)
+	}
+	dir = d
+	if !dry {
+		if err := store.MkdirAll(dir); err != nil {
+			fatalf("Unable to create %s: %v", dir, err)
+		}
+		// check first, or a read-only directory is reported as a
+		// lock file that cannot be opened
+		if err := checkWritable(dir); err != nil {
+			fatalf("%v", err)
+		}
+		if err := acquireLock(dir); err != nil {
+			fatalf("%v", err)
+		}
+		defer releaseLock()
+	}
+	if events != "" {
+		if err := openEvents(events); err != nil {
+			fatalf("%v", err)
+		}
+		defer closeEvents()
+	}
+
+	// on the first interrupt, let downloads in progress finish but start
+	// no more; on the second, cancel the downloads in progress; on the
+	// third, quit right away. Files are only renamed into place when
+	// complete, so quitting never leaves a partial file.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var cancelDownloads context.CancelFunc
+	downloads, cancelDownloads = context.WithCancel(context.Background())
+	defer cancelDownloads()
+	interrupts := make(chan os.Signal, 3)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		log.Printf("Interrupted, finishing downloads in progress (interrupt again to cancel them)")
+		cancel()
+		<-interrupts
+		log.Printf("Interrupted again, canceling downloads in progress (interrupt again to quit now)")
+		cancelDownloads()
+		<-interrupts
+		log.Printf("Interrupted again, quitting")
+		closeEvents()
+		releaseLock()
+		os.Exit(130)
+	}()
+
+	// sync each account in turn, into its own subdirectory if there are several
+	base := dir
+	pauseDir = base
+	var results []*accountResult
+	for _, a := range accounts {
+		if ctx.Err() != nil {
+			break
+		}
+		a.use()
+		dir = base
+		if acctsFile != "" {
+			dir = filepath.Join(base, a.Dir)
+			log.Printf("Syncing account %s into %s", a.Name, dir)
+		}
+		results = append(results, syncAccount(ctx, a))
+	}
+	dir = base
+	if dry && !listOnly && !reportDups && !checkOnly {
+		plan.report()
+	}
+
+	// report each account separately
+	var files, bytes int64
+	var albumCount, failCount int
+	for _, res := range results {
+		files += res.files
+		bytes += res.bytes
+		albumCount += res.albums
+		failCount += len(res.failures)
+		if ctx.Err() != nil {
+			log.Printf("Interrupted: %d of %d albums fully synced%s", res.completed, res.albums, res.label())
+		}
+		if acctsFile != "" {
+			log.Printf("Account %s: downloaded %d files (%s), %d failures", res.name, res.files, formatSize(res.bytes), len(res.failures))
+		}
+	}
+	if statsFile != "" {
+		run.Start = start
+		run.Duration = since(start).Seconds()
+		run.AlbumsScanned = albumCount
+		run.FilesDownloaded = files
+		run.BytesDownloaded = bytes
+		run.Interrupted = ctx.Err() != nil
+		if err := run.write(statsFile); err != nil {
+			logError(event{}, "%v", err)
+		}
+	}
+
+	if ctx.Err() == nil && !listOnly && !reportDups && !checkOnly {
+		if err := syncHook.run("-post-sync-hook", &hookFields{Path: dir, Files: files, Bytes: bytes}); err != nil {
+			if hookFatal {
+				logError(event{}, "%v", err)
+				failCount++
+			} else {
+				logWarn(event{}, "Warning: %v", err)
+			}
+		}
+	}
+
+	if failCount > 0 {
+		for _, res := range results {
+			if len(res.failures) == 0 {
+				continue
+			}
+			log.Printf("%d failures%s:", len(res.failures), res.label())
+			for _, failure := range res.failures {
+				log.Printf("    %s", failure)
+			}
+		}
+		closeEvents()
+		releaseLock()
+		os.Exit(1)
+	}
+	if ctx.Err() != nil {
+		closeEvents()
+		releaseLock()
+		os.Exit(130)
+	}
+}
+
+// syncAccount syncs the albums of one account into dir.
+// Failures are collected in the result rather than ending the run.
+func syncAccount(ctx context.Context, a *account) *accountResult {
+	start := clk.Now()
+	result := &accountResult{name: a.Name}
+	atomic.StoreInt64(&fileCount, 0)
+	atomic.StoreInt64(&totalBytes, 0)
+	dedup = &dedupIndex{paths: make(map[string]string)}
+	owners = &pathOwners{keys: make(map[string]string)}
+
+	// stop ends the sync of this account with a failure, leaving main
+	// to release the lock and report it
+	stop := func(msg string) *accountResult {
+		logError(event{Event: "error", Error: msg}, "%s", msg)
+		result.failures = append(result.failures, msg)
+		run.fail(msg)
+		return result
+	}
+
+	if !dry {
+		if err := checkWritable(dir); err != nil {
+			return stop(err.Error())
+		}
+	}
+	if checkfs {
+		if err := checkFS(dir); err != nil {
+			return stop(fmt.Sprintf("Filesystem check failed: %v", err))
+		}
+	}
+
+	if parts != "ignore" {
+		if err := scanParts(dir, parts == "remove"); err != nil {
+			return stop(fmt.Sprintf("Error scanning for partial downloads: %v", err))
+		}
+	}
+
+	cache = nil
+	if !noCache {
+		var err error
+		if cache, err = loadCache(filepath.Join(dir, cacheName)); err != nil {
+			return stop(err.Error())
+		}
+	}
+
+	// login
+	c, err := a.provider.Login()
+	if err != nil {
+		logError(event{Event: "error", Error: err.Error()}, "Login error: %v", err)
+		result.failures = append(result.failures, fmt.Sprintf("login: %v", err))
+		run.fail(fmt.Sprintf("login: %v", err))
+		return result
+	}
+	log.Printf("Logged in, NickName is %s", c.NickName())
+
+	// get full list of albums
+	var albums []*smugmug.AlbumInfo
+	err = callWithRetry(ctx, "album list", func() (err error) {
+		albums, err = c.Albums(c.NickName())
+		return err
+	})
+	if err != nil {
+		logError(event{Event: "error", Error: err.Error()}, "Albums error: %v", err)
+		result.failures = append(result.failures, fmt.Sprintf("album list: %v", err))
+		run.fail(fmt.Sprintf("album list: %v", err))
+		return result
+	}
+	log.Printf("Found %d albums", len(albums))
+
+	// the smugmug package cannot look up a single album,
+	// so named albums are picked out of the full list
+	if len(named) > 0 {
+		if albums, err = namedAlbums(albums, named); err != nil {
+			return stop(err.Error())
+		}
+		log.Printf("Selected %d albums named by -album", len(albums))
+	}
+
+	// filter before dispatching so job slots go to albums we want
+	if category != "" && len(named) == 0 {
+		var keep []*smugmug.AlbumInfo
+		for _, album := range albums {
+			if inCategory(album, category) {
+				keep = append(keep, album)
+			}
+		}
+		albums = keep
+		log.Printf("Found %d albums in category %s", len(albums), category)
+	}
+	if sinceFlag != "" && len(named) == 0 {
+		threshold, err := parseSince(sinceFlag)
+		if err != nil {
+			return stop(fmt.Sprintf("Invalid -since: %v", err))
+		}
+		var keep []*smugmug.AlbumInfo
+		for _, album := range albums {
+			updated, err := parseTime(album.LastUpdated)
+			if err != nil {
+				return stop(fmt.Sprintf("Unable to parse timestamp %q of album %s: %v", album.LastUpdated, album.URL, err))
+			}
+			if !updated.Before(threshold) {
+				keep = append(keep, album)
+			}
+		}
+		albums = keep
+		log.Printf("Found %d albums updated since %s", len(albums), threshold.Format(timeFormat))
+	}
+	if (len(includes) > 0 || len(excludes) > 0) && len(named) == 0 {
+		var keep []*smugmug.AlbumInfo
+		for _, album := range albums {
+			if wantAlbum(album) {
+				keep = append(keep, album)
+			}
+		}
+		albums = keep
+		log.Printf("Found %d albums matching -include and -exclude", len(albums))
+	}
+
+	// albums must not share a directory, or cleaning up one album would
+	// delete the files of the other. Titles that differ only in case or
+	// in characters that sanitizeName replaces, or that are merged by
+	// -max-depth, end up in the same place.
+	if albumDirs() {
+		seen := make(map[string]string)
+		for _, album := range albums {
+			path := albumPath(album)
+			key := strings.ToLower(path)
+			if other, present := seen[key]; present {
+				return stop(fmt.Sprintf("Albums %s and %s would both be stored in %s", other, album.URL, path))
+			}
+			seen[key] = album.URL
+		}
+	}
+
+	// record the structure of the account before changing anything
+	if treeFile != "" {
+		if err := dumpTree(c, albums, treeFile, a.Name); err != nil {
+			logError(event{}, "Error writing album tree: %v", err)
+			result.failures = append(result.failures, fmt.Sprintf("album tree: %v", err))
+			return result
+		}
+		log.Printf("Wrote %d albums to %s", len(albums), treeFile)
+	}
+
+	// just fix directory timestamps and quit
+	if touch {
+		for _, album := range albums {
+			if err := touchAlbum(c, album); err != nil {
+				return stop(fmt.Sprintf("Error touching album %s: %v", album.URL, err))
+			}
+		}
+		log.Printf("Finished updating timestamps in %v", since(start))
+		return result
+	}
+
+	// just list the albums and quit
+	if listOnly {
+		for _, album := range albums {
+			log.Printf("%s [%s] (updated %s, %d images)", albumPath(album), album.URL, album.LastUpdated, album.ImageCount)
+		}
+		return result
+	}
+
+	// just look for images in several albums and quit
+	if reportDups {
+		if err := reportDuplicates(c, albums); err != nil {
+			logError(event{}, "Error finding duplicates: %v", err)
+			result.failures = append(result.failures, fmt.Sprintf("duplicates report: %v", err))
+		}
+		return result
+	}
+
+	// just compare the local files with the server and quit
+	if checkOnly {
+		total := new(integrity)
+		for _, album := range albums {
+			found, err := checkAlbum(c, album)
+			if err != nil && isAccessError(err) {
+				skipInaccessible(album, err)
+				continue
+			} else if err != nil {
+				logError(event{}, "Error checking album %s: %v", album.URL, err)
+				result.failures = append(result.failures, fmt.Sprintf("%s: %v", album.URL, err))
+				continue
+			}
+			total.add(found)
+			if *found != (integrity{}) {
+				result.failures = append(result.failures, fmt.Sprintf("%s: %v", album.URL, found))
+			}
+		}
+		log.Printf("Checked %d albums: %v", len(albums), total)
+		return result
+	}
+
+	// longest-processing-time-first: the album list does not include
+	// sizes, so the image count stands in for the amount of work until
+	// -progress lists the images (see scheduleBySize)
+	if smart {
+		sort.SliceStable(albums, func(i, j int) bool { return albums[i].ImageCount > albums[j].ImageCount })
+	}
+
+	// work is cancelled to stop starting new albums
+	var failMutex sync.Mutex
+	work, stopWork := context.WithCancel(ctx)
+	defer stopWork()
+
+	// list every album up front so overall progress has totals to report.
+	// This costs what -fast and listing one album at a time save: every
+	// album is listed even if its timestamp matches, and all the lists
+	// are held until the sync is done. An album that cannot be listed
+	// fails here, like one that fails in the worker pool, and is not
+	// queued.
+	var lists []*imageList
+	var unlisted []bool
+	stopProgress := make(chan struct{})
+	if progress {
+		overall = new(totalProgress)
+		lists = make([]*imageList, len(albums))
+		unlisted = make([]bool, len(albums))
+		for i, album := range albums {
+			lists[i] = fetchImages(work, c, album)
+			images, err := lists[i].wait()
+			if err != nil && isAccessError(err) {
+				// processAlbum will report it
+				continue
+			} else if err != nil {
+				err = fmt.Errorf("Images error: %v", err)
+				emit(event{Event: "error", Album: album.URL, Error: err.Error()})
+				logError(event{Event: "error", Album: album.URL, Error: err.Error()}, "Error processing album %s: %v", album.URL, err)
+				result.failures = append(result.failures, fmt.Sprintf("%s: %v", album.URL, err))
+				run.fail(fmt.Sprintf("%s: %v", album.URL, err))
+				unlisted[i] = true
+				if !keepOn {
+					stopWork()
+					break
+				}
+				continue
+			}
+			overall.expect(images)
+		}
+		if smart && work.Err() == nil {
+			scheduleBySize(albums, lists, unlisted)
+		}
+		overall.report()
+		go func() {
+			ticker := time.NewTicker(totalProgressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					overall.report()
+				case <-stopProgress:
+					return
+				}
+			}
+		}()
+	}
+
+	// process the albums with a pool of -jobs workers, so at most that
+	// many albums (plus the next one being listed) are held in memory at
+	// once. Without -keep-going, the first failure stops the pool from
+	// starting any more albums.
+	result.albums = len(albums)
+	type albumJob struct {
+		album *smugmug.AlbumInfo
+		list  *imageList
+	}
+	queue := make(chan albumJob)
+	adapt = nil
+	if adaptive {
+		adapt = newConcurrency(jobs)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				album := job.album
+				adapt.acquire()
+				err := processAlbum(work, c, album, job.list)
+				adapt.release()
+				if err == errInterrupted {
+					logEvent(event{Event: "interrupted", Album: album.URL}, "Album %s was interrupted and will be finished next run", album.URL)
+					emit(event{Event: "interrupted", Album: album.URL})
+				} else if err != nil {
+					emit(event{Event: "error", Album: album.URL, Error: err.Error()})
+					logError(event{Event: "error", Album: album.URL, Error: err.Error()}, "Error processing album %s: %v", album.URL, err)
+					failMutex.Lock()
+					result.failures = append(result.failures, fmt.Sprintf("%s: %v", album.URL, err))
+					failMutex.Unlock()
+					run.fail(fmt.Sprintf("%s: %v", album.URL, err))
+					if !keepOn {
+						stopWork()
+					}
+				} else {
+					atomic.AddInt64(&result.completed, 1)
+				}
+			}
+		}()
+	}
+
+	var next *imageList
+feed:
+	for i, album := range albums {
+		if work.Err() != nil {
+			break
+		}
+		list := next
+		next = nil
+		if lists != nil {
+			if unlisted[i] {
+				continue
+			}
+			list = lists[i]
+		}
+		select {
+		case queue <- albumJob{album: album, list: list}:
+		case <-work.Done():
+			break feed
+		}
+
+		// start listing the next album while this one downloads
+		if lists == nil && prefetch && i+1 < len(albums) {
+			next = fetchImages(work, c, albums[i+1])
+		}
+	}
+	// a list prefetched for an album that was never queued
+	if next != nil {
+		next.stop()
+	}
+	close(queue)
+	wg.Wait()
+	close(stopProgress)
+
+	// skip pruning after an interrupt or failure, when the tree may be half updated
+	if pruneDirs && ctx.Err() == nil && len(result.failures) == 0 {
+		keep := make(map[string]bool)
+		for _, album := range albums {
+			keep[albumPath(album)] = true
+		}
+		if err := pruneEmptyDirs(keep); err != nil {
+			logError(event{}, "Error pruning empty directories: %v", err)
+		}
+	}
+
+	files, bytes := atomic.LoadInt64(&fileCount), atomic.LoadInt64(&totalBytes)
+	if bytes > 1024*1024 {
+		log.Printf("Downloaded %d files (%.1fm) in %v", files, float64(bytes)/(1024*1024), since(start))
+	} else if bytes > 1024 {
+		log.Printf("Downloaded %d files (%.1fk) in %v", files, float64(bytes)/1024, since(start))
+	} else {
+		log.Printf("Downloaded %d files (%d bytes) in %v", files, bytes, since(start))
+	}
+	saveCache()
+	result.files, result.bytes = files, bytes
+
+	return result
+}
+
+// categories returns the names of the category and subcategory
+// (if any) that an album belongs to. Albums without a category
+// are placed in the -uncategorized category.
+func categories(album *smugmug.AlbumInfo) []string {
+	var levels []string
+	if album.Category != nil && strings.TrimSpace(album.Category.Name) != "" {
+		levels = append(levels, album.Category.Name)
+	} else {
+		levels = append(levels, uncat)
+	}
+	if album.SubCategory != nil && strings.TrimSpace(album.SubCategory.Name) != "" {
+		levels = append(levels, album.SubCategory.Name)
+	}
+	return levels
+}
+
+// albumTitle returns the name to use for an album's directory. An
+// album with a blank title would otherwise share a directory with
+// every other untitled album, so it falls back to the album's key,
+// which does not change from one run to the next.
+func albumTitle(album *smugmug.AlbumInfo) string {
+	if strings.TrimSpace(album.Title) != "" {
+		return album.Title
+	}
+	if album.Key != "" {
+		return album.Key
+	}
+	return fmt.Sprintf("album-%d", album.ID)
+}
+
+// inCategory reports whether an album is in the named category,
+// given as a category name or a category/subcategory path.
+func inCategory(album *smugmug.AlbumInfo, name string) bool {
+	want := strings.Split(strings.Trim(name, "/"), "/")
+	have := categories(album)
+	if len(want) > len(have) {
+		return false
+	}
+	for i := range want {
+		if want[i] != have[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// wantAlbum reports whether an album's full Category/SubCategory/Title
+// path matches an -include pattern (if any) and no -exclude pattern.
+func wantAlbum(album *smugmug.AlbumInfo) bool {
+	name := strings.Join(append(categories(album), albumTitle(album)), "/")
+	for _, pattern := range excludes {
+		if matched, _ := pathpkg.Match(pattern, name); matched {
+			return false
+		}
+	}
+	if len(includes) == 0 {
+		return true
+	}
+	for _, pattern := range includes {
+		if matched, _ := pathpkg.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// namedAlbums returns the albums whose URL, key, or ID is in names,
+// in the order they are named. Every name must match an album.
+func namedAlbums(albums []*smugmug.AlbumInfo, names []string) ([]*smugmug.AlbumInfo, error) {
+	var keep []*smugmug.AlbumInfo
+	seen := make(map[*smugmug.AlbumInfo]bool)
+	for _, name := range names {
+		var found *smugmug.AlbumInfo
+		for _, album := range albums {
+			if name == album.Key || name == strconv.Itoa(album.ID) ||
+				strings.TrimSuffix(name, "/") == strings.TrimSuffix(album.URL, "/") {
+				found = album
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("No album with URL, key, or ID %q", name)
+		}
+		if !seen[found] {
+			seen[found] = true
+			keep = append(keep, found)
+		}
+	}
+	return keep, nil
+}
+
+// albumPath returns the path of an album's directory relative to dir.
+// Only the top maxDepth category levels are included.
+func albumPath(album *smugmug.AlbumInfo) string {
+	levels := categories(album)
+	if maxDepth >= 0 && len(levels) > maxDepth {
+		levels = levels[:maxDepth]
+	}
+	var elts []string
+	for _, level := range append(levels, albumTitle(album)) {
+		elts = append(elts, sanitizeName(level))
+	}
+	return filepath.Join(elts...)
+}
+
+// albumDirs reports whether each album has a directory of its own.
+// Fast skipping, cleanup, and directory timestamps depend on it.
+func albumDirs() bool {
+	return layout == "category" && pathTemplate == nil
+}
+
+// imagePath returns the path of an image's file relative to dir,
+// according to -path-template or -layout.
+func imagePath(album *smugmug.AlbumInfo, image *smugmug.ImageInfo) (string, error) {
+	name := sanitizeName(image.FileName)
+	if image.FileName == "" {
+		name = fmt.Sprintf("%s-%d.jpg", image.Key, image.ID)
+	}
+	if pathTemplate != nil {
+		return templatePath(album, image, name)
+	}
+
+	switch layout {
+	case "flat":
+		return name, nil
+	case "date":
+		stamp := image.Date
+		if stamp == "" {
+			stamp = image.LastUpdated
+		}
+		when, err := parseTime(stamp)
+		if err != nil {
+			return filepath.Join("unknown", name), nil
+		}
+		return filepath.Join(when.Format("2006"), when.Format("01"), name), nil
+	}
+	if datedDirs {
+		return filepath.Join(albumPath(album), dateBucket(image), name), nil
+	}
+	return filepath.Join(albumPath(album), name), nil
+}
+
+// dateBucket returns the -dir-per-date subdirectory for an image:
+// the month it was taken, or "undated" if that is unknown.
+func dateBucket(image *smugmug.ImageInfo) string {
+	if when, err := parseTime(image.Date); err == nil {
+		return when.Format("2006-01")
+	}
+	return "undated"
+}
+
+// keep marks a local file as existing on the server, along with the
+// directories that hold it, so cleanup leaves them alone.
+func keep(localFiles map[string]string, path string) {
+	for ; path != "." && path != "/"; path = filepath.Dir(path) {
+		delete(localFiles, path)
+	}
+}
+
+// claimPaths assigns each image in an album its local path. When two
+// images would share a path, the later one in the album's order gets
+// its key added to the name, e.g., IMG_1234__<Key>.jpg. Paths are
+// compared without case so they are distinct on any file system.
+//
+// When albums share directories (-layout flat or date, or
+// -path-template), paths claimed by images in other albums are taken
+// too, so the first album to reach a name keeps it. An image that
+// appears in several albums keeps a single path.
+func claimPaths(album *smugmug.AlbumInfo, images []*smugmug.ImageInfo) (map[*smugmug.ImageInfo]string, error) {
+	shared := !albumDirs()
+	if shared {
+		owners.Lock()
+		defer owners.Unlock()
+	}
+	paths := make(map[*smugmug.ImageInfo]string)
+	claimed := make(map[string]bool)
+	taken := func(path string, image *smugmug.ImageInfo) bool {
+		key := strings.ToLower(path)
+		if claimed[key] {
+			return true
+		}
+		owner, present := owners.keys[key]
+		return shared && present && owner != image.Key
+	}
+	for _, image := range images {
+		path, err := imagePath(album, image)
+		if err != nil {
+			return nil, err
+		}
+		if taken(path, image) {
+			ext := filepath.Ext(path)
+			base := strings.TrimSuffix(path, ext)
+			path = fmt.Sprintf("%s__%s%s", base, image.Key, ext)
+			if taken(path, image) {
+				path = fmt.Sprintf("%s__%s-%d%s", base, image.Key, image.ID, ext)
+			}
+		}
+		claimed[strings.ToLower(path)] = true
+		if shared {
+			owners.keys[strings.ToLower(path)] = image.Key
+		}
+		paths[image] = path
+	}
+	return paths, nil
+}
+
+// pathOwners maps each path claimed so far in the account to the key
+// of the image stored there, for layouts where albums share directories.
+type pathOwners struct {
+	sync.Mutex
+	keys map[string]string
+}
+
+var owners = &pathOwners{keys: make(map[string]string)}
+
+// imageList is an album's list of images being fetched in the background.
+type imageList struct {
+	images []*smugmug.ImageInfo
+	err    error
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+// fetchImages starts listing an album's images. Retries stop once ctx
+// is done, but a request already sent runs to completion.
+func fetchImages(ctx context.Context, c smugClient, album *smugmug.AlbumInfo) *imageList {
+	ctx, cancel := context.WithCancel(ctx)
+	list := &imageList{done: make(chan struct{}), cancel: cancel}
+	go func() {
+		list.err = callWithRetry(ctx, album.Title, func() (err error) {
+			list.images, err = c.Images(album)
+			return err
+		})
+		close(list.done)
+	}()
+	return list
+}
+
+func (list *imageList) wait() ([]*smugmug.ImageInfo, error) {
+	<-list.done
+	return list.images, list.err
+}
+
+// waitContext is like wait, but gives up with errInterrupted
+// if ctx is done first.
+func (list *imageList) waitContext(ctx context.Context) ([]*smugmug.ImageInfo, error) {
+	select {
+	case <-list.done:
+		return list.images, list.err
+	case <-ctx.Done():
+		return nil, errInterrupted
+	}
+}
+
+// stop abandons the listing if it is still going and waits for the
+// background work to finish, so none outlives the album it was for.
+func (list *imageList) stop() {
+	list.cancel()
+	<-list.done
+}
+
+// scheduleBySize reorders albums for -smart-schedule once their images
+// are listed, largest total size first, since bytes to download track
+// the work better than the image count. lists and unlisted are
+// reordered along with albums.
+func scheduleBySize(albums []*smugmug.AlbumInfo, lists []*imageList, unlisted []bool) {
+	type entry struct {
+		album    *smugmug.AlbumInfo
+		list     *imageList
+		unlisted bool
+		size     int64
+	}
+	entries := make([]entry, len(albums))
+	for i, album := range albums {
+		entries[i] = entry{album: album, list: lists[i], unlisted: unlisted[i]}
+		if images, err := lists[i].wait(); err == nil {
+			for _, image := range images {
+				entries[i].size += int64(image.Size)
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].size > entries[j].size })
+	for i, e := range entries {
+		albums[i], lists[i], unlisted[i] = e.album, e.list, e.unlisted
+	}
+}
+
+// downloads is canceled to abort the downloads in progress,
+// after a second interrupt.
+var downloads = context.Background()
+
+// errInterrupted is returned when an album is left incomplete because
+// of an interrupt. Nothing that marks the album as done (checksums,
+// cleanup, or the directory timestamp) is updated.
+var errInterrupted = errors.New("interrupted")
+
+// processAlbum syncs a single album. If list is not nil,
+// it is used instead of fetching the list of images. With
+// -album-timeout, an album that runs too long is abandoned along with
+// its downloads in progress, and reported as failed. Like an
+// interrupted album, it is left marked as incomplete.
+func processAlbum(ctx context.Context, c smugClient, album *smugmug.AlbumInfo, list *imageList) error {
+	if albumLimit <= 0 {
+		return syncAlbum(ctx, downloads, c, album, list)
+	}
+	deadline := clk.Now().Add(albumLimit)
+	actx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	dl, cancelDownloads := context.WithDeadline(downloads, deadline)
+	defer cancelDownloads()
+	err := syncAlbum(actx, dl, c, album, list)
+	if err != nil && actx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", albumLimit)
+	}
+	return err
+}
+
+// syncAlbum does the work of processAlbum. New work stops when ctx is
+// done, and downloads in progress stop when dl is done.
+func syncAlbum(ctx, dl context.Context, c smugClient, album *smugmug.AlbumInfo, list *imageList) error {
+	path := albumPath(album)
+	fullpath := filepath.Join(dir, path)
+	defer func() {
+		if list != nil {
+			list.stop()
+		}
+	}()
+	if dirTime == "newest-image" && list == nil {
+		list = fetchImages(ctx, c, album)
+	}
+	updated, err := albumTime(album, list)
+	if err != nil && isAccessError(err) {
+		skipInaccessible(album, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// see if we can skip this based on a time stamp
+	if fast && albumDirs() {
+		info, err := store.Stat(fullpath)
+		if err == nil && info.IsDir() && info.ModTime().Equal(updated) {
+			e := event{Event: "skip", Album: album.URL, Path: path, Reason: "timestamp matches"}
+			logAt(levelNormal, e, "Skipping %s [%s], timestamp of %s matches", path, album.URL, updated.Format(timeFormat))
+			emit(e)
+			plan.album(true)
+			run.album(true)
+			if overall != nil {
+				if images, err := list.wait(); err == nil {
+					overall.finishAll(images)
+				}
+			}
+			return nil
+		}
+	}
+	plan.album(false)
+
+	// the smugmug package only returns complete image lists, so the
+	// best we can do is fetch the list while scanning the local files
+	if list == nil {
+		list = fetchImages(ctx, c, album)
+	}
+
+	logAt(levelNormal, event{Event: "process", Album: album.URL, Path: path}, "Processing %s [%s] (updated %s)", path, album.URL, album.LastUpdated)
+
+	// scan the local directory: map path to md5sum
+	localFiles := make(map[string]string)
+	ignorePatterns := map[string][]string{filepath.Dir(fullpath): ignores}
+	var toHash []hashJob
+	if info, err := store.Stat(fullpath); err == nil && info.IsDir() && albumDirs() && !newOnly {
+		if err := store.Walk(fullpath, filepath.WalkFunc(func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			suffix := path
+			if strings.HasPrefix(path, dir+"/") {
+				suffix = path[len(dir)+1:]
+			}
+
+			// leave ignored files alone, along with the directories holding them
+			patterns := ignorePatterns[filepath.Dir(path)]
+			if rel, err := filepath.Rel(fullpath, path); err == nil && rel != "." && isIgnored(rel, patterns) {
+				for parent := filepath.Dir(suffix); parent != "." && parent != "/"; parent = filepath.Dir(parent) {
+					delete(localFiles, parent)
+				}
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if info.IsDir() {
+				ignorePatterns[path] = append(patterns[:len(patterns):len(patterns)], readIgnoreFile(path)...)
+				localFiles[suffix] = "directory"
+				return nil
+			}
+
+			// downloads in progress are not part of the album
+			if strings.HasSuffix(path, partSuffix) || strings.HasSuffix(path, stateSuffix) {
+				return nil
+			}
+
+			// our own manifest is not user content
+			if manifest && suffix == filepath.Join(albumPath(album), manifestName) {
+				return nil
+			}
+
+			// hash files once the walk is done, so they can be hashed in parallel
+			toHash = append(toHash, hashJob{key: suffix, fullpath: path, info: info})
+			return nil
+		})); err != nil && err != os.ErrNotExist {
+			return fmt.Errorf("error walking local file system: %v", err)
+		}
+	}
+	if err := hashFiles(cache, toHash, localFiles); err != nil {
+		logError(event{}, "%v", err)
+		return err
+	}
+	localCount := 0
+	for _, v := range localFiles {
+		if v != "directory" {
+			localCount++
+		}
+	}
+
+	// get full list of images from this album
+	images, err := list.waitContext(ctx)
+	if err == errInterrupted {
+		return err
+	} else if err != nil && isAccessError(err) {
+		skipInaccessible(album, err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Images error: %v", err)
+	}
+	paths, err := claimPaths(album, images)
+	if err != nil {
+		return err
+	}
+	if normalize {
+		matchNormalized(paths, localFiles)
+	}
+
+	// other layouts share directories between albums,
+	// so only look at the files this album would use
+	if !albumDirs() && !newOnly {
+		for _, img := range images {
+			imgpath := paths[img]
+			info, err := store.Stat(filepath.Join(dir, imgpath))
+			if err != nil || info.IsDir() {
+				continue
+			}
+			if localFiles[imgpath], err = cache.hash(imgpath, filepath.Join(dir, imgpath), info); err != nil {
+				return err
+			}
+		}
+	}
+
+	dedup.addAll(localFiles)
+
+	// put the images in the requested order
+	switch order {
+	case "small-first":
+		sort.SliceStable(images, func(i, j int) bool { return images[i].Size < images[j].Size })
+	case "large-first":
+		sort.SliceStable(images, func(i, j int) bool { return images[i].Size > images[j].Size })
+	}
+
+	// process each image
+	stats := &albumStats{
+		sums:    make(map[string]string),
+		orphans: findOrphans(localFiles, paths),
+		urls:    &freshURLs{c: c, album: album},
+	}
+	work := make(chan *smugmug.ImageInfo)
+	errs := make(chan error, fileJobs)
+	var wg sync.WaitGroup
+	for i := 0; i < fileJobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for img := range work {
+				if err := waitIfPaused(ctx); err != nil {
+					errs <- err
+					return
+				}
+				if err := syncFile(ctx, dl, album, img, paths[img], localFiles, dir, stats); err == errInterrupted {
+					errs <- err
+					return
+				} else if err != nil {
+					errs <- fmt.Errorf("Error processing image %s from album %s in category %s: %v",
+						img.FileName, album.Title, strings.Join(categories(album), "/"), err)
+					return
+				}
+			}
+		}()
+	}
+
+	// stop handing out images after the first error
+	var failed error
+	for _, img := range images {
+		select {
+		case work <- img:
+			continue
+		case failed = <-errs:
+		case <-ctx.Done():
+			failed = errInterrupted
+		}
+		break
+	}
+	close(work)
+	wg.Wait()
+	if failed == nil {
+		select {
+		case failed = <-errs:
+		default:
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+
+	if sumsFile {
+		if err := writeChecksums(album, stats.sums, localFiles, dir); err != nil {
+			return err
+		}
+	}
+	if albumMD {
+		if err := writeAlbumMetadata(album, localFiles, dir); err != nil {
+			return err
+		}
+	}
+	if emptyMarker && len(images) == 0 {
+		if err := writeEmptyMarker(album, localFiles, dir); err != nil {
+			return err
+		}
+	}
+	if manifest {
+		if err := writeManifest(album, images, paths, dir); err != nil {
+			return err
+		}
+	}
+
+	// delete extra files
+	if !noClean && albumDirs() && !tooManyDeletes(path, localFiles, localCount) {
+		if err = cleanup(localFiles, dir, stats); err != nil {
+			return fmt.Errorf("Error cleaning up: %v", err)
+		}
+	}
+	run.deleted(stats.deleted)
+	if compact {
+		logAt(levelNormal, event{Event: "summary", Album: album.URL, Path: path}, "    %s: %d unchanged, %d skipped, %d downloaded, %d deleted",
+			path, stats.unchanged, stats.skipped, stats.downloaded, stats.deleted)
+	}
+
+	// update the directory timestamp to match; an album with no
+	// images (and no -empty-album-marker) has no directory
+	if !dry && dirTimes && albumDirs() {
+		if err = store.Chtimes(fullpath, updated); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to set timestamp on directory %s: %v", fullpath, err)
+		}
+	}
+	fields := &hookFields{Album: album.URL, Path: fullpath, Files: int64(stats.downloaded), Bytes: stats.bytes}
+	if err := albumHook.run("-post-album-hook", fields); err != nil {
+		if hookFatal {
+			return err
+		}
+		logWarn(event{}, "Warning: %v", err)
+	}
+	emit(event{Event: "album-complete", Album: album.URL, Path: path})
+	run.album(false)
+
+	return nil
+}
+
+// albumTime returns the timestamp for an album's directory.
+// For -dir-time-from newest-image, list must not be nil; images with a
+// missing or unparseable date are passed over, and an album with no
+// dated images falls back to its last update.
+func albumTime(album *smugmug.AlbumInfo, list *imageList) (time.Time, error) {
+	updated, err := parseTime(album.LastUpdated)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Unable to parse timestamp %q: %v", album.LastUpdated, err)
+	}
+	if dirTime != "newest-image" {
+		return updated, nil
+	}
+
+	images, err := list.wait()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Images error: %v", err)
+	}
+	var newest time.Time
+	for _, image := range images {
+		// images without a usable date do not count
+		when, err := parseTime(image.Date)
+		if err != nil {
+			continue
+		}
+		if when.After(newest) {
+			newest = when
+		}
+	}
+
+	// an empty album has no images to go by
+	if newest.IsZero() {
+		return updated, nil
+	}
+	return newest, nil
+}
+
+// skipInaccessible reports an album that is listed but cannot be read.
+func skipInaccessible(album *smugmug.AlbumInfo, err error) {
+	e := event{Event: "skip", Album: album.URL, Reason: "inaccessible", Error: err.Error()}
+	logWarn(e, "Warning: skipping inaccessible album %s: %v", album.URL, err)
+	emit(e)
+	run.album(true)
+}
+
+func touchAlbum(c smugClient, album *smugmug.AlbumInfo) error {
+	path := albumPath(album)
+	fullpath := filepath.Join(dir, path)
+	var list *imageList
+	if dirTime == "newest-image" {
+		list = fetchImages(context.Background(), c, album)
+	}
+	updated, err := albumTime(album, list)
+	if err != nil {
+		return err
+	}
+
+	// only touch directories that already exist
+	info, err := store.Stat(fullpath)
+	if err != nil || !info.IsDir() {
+		log.Printf("Skipping %s [%s], no local directory", path, album.URL)
+		return nil
+	}
+	if info.ModTime().Equal(updated) {
+		return nil
+	}
+	if dry {
+		log.Printf("dry run, not setting timestamp on %s to %s", path, updated.Format(timeFormat))
+		return nil
+	}
+	log.Printf("Setting timestamp on %s to %s", path, updated.Format(timeFormat))
+	if err = store.Chtimes(fullpath, updated); err != nil {
+		return fmt.Errorf("failed to set timestamp on directory %s: %v", fullpath, err)
+	}
+
+	return nil
+}
 
-	// parse config
-	configString(&apiKey, "apikey", "", "SmugMug API key")
-	configString(&email, "email", "", "Email address")
-	configString(&password, "password", "", "Password")
-	configString(&dir, "dir", "", "Target directory")
-	flag.BoolVar(&dry, "dry", false, "Dry run (no changes)")
-	flag.BoolVar(&del, "delete", true, "Delete local files not in album")
-	flag.BoolVar(&fast, "fast", true, "Skip albums with timestamp match")
-	flag.BoolVar(&videos, "videos", true, "Download videos")
-	flag.BoolVar(&pics, "pics", true, "Download pictures")
-	flag.IntVar(&jobs, "jobs", 1, "Number of concurrent jobs to run")
-	flag.Parse()
-	if flag.NArg() != 0 {
-		log.Fatalf("Unknown command-line options: %s", strings.Join(flag.Args(), " "))
+// albumStats counts what happened to the files in one album.
+// The lock is held to update it or the album's localFiles map.
+type albumStats struct {
+	sync.Mutex
+	unchanged  int
+	skipped    int
+	downloaded int
+	deleted    int
+	bytes      int64
+
+	// sums maps the path of each file kept in the album to its MD5 sum
+	sums map[string]string
+
+	// orphans maps MD5 sums to local files that no image claims
+	orphans map[string][]string
+
+	// urls replaces download URLs that have expired
+	urls *freshURLs
+}
+
+func syncFile(ctx, dl context.Context, album *smugmug.AlbumInfo, image *smugmug.ImageInfo, path string, localFiles map[string]string, dir string, stats *albumStats) error {
+	defer overall.finish(int64(image.Size))
+
+	// a change to the caption, keywords, or date leaves the MD5 sum alone,
+	// so compare them with what we saw last time
+	var metaChanged bool
+	if metaHash {
+		digest := metadataDigest(image)
+		metaChanged = cache.metaChanged(path, digest)
+		defer cache.recordMeta(path, digest)
 	}
-	if apiKey == "" || email == "" || password == "" {
-		log.Fatalf("apikey, email, and password are all required")
+
+	if captions && image.Caption != "" {
+		if err := writeSidecar(path+".txt", []byte(image.Caption+"\n"), localFiles, dir, stats); err != nil {
+			return err
+		}
 	}
-	if dir == "" {
-		dir = "."
+	if tags {
+		if keywords := keywordList(image.Keywords); len(keywords) > 0 {
+			if err := writeSidecar(path+".tags", []byte(strings.Join(keywords, "\n")+"\n"), localFiles, dir, stats); err != nil {
+				return err
+			}
+		}
 	}
-	d, err := filepath.Abs(dir)
-	if err != nil {
-		log.Fatalf("Unable to find absolute path for %s: %v", dir, err)
+	if imageMD {
+		data, err := json.MarshalIndent(image, "", "    ")
+		if err != nil {
+			return fmt.Errorf("error encoding image metadata: %v", err)
+		}
+		if err := writeSidecar(path+".json", append(data, '\n'), localFiles, dir, stats); err != nil {
+			return err
+		}
 	}
-	dir = d
 
-	// login
-	c, err := smugmug.Login(email, password, apiKey)
-	if err != nil {
-		log.Fatalf("Login error: %v", err)
+	stats.Lock()
+	localSum := localFiles[path]
+	changed, fetch := checkFile(album, image, path, localFiles, stats)
+	stats.Unlock()
+	fullpath := filepath.Join(dir, path)
+	if !fetch {
+		if metaChanged && localSum != "" {
+			e := event{Event: "metadata", Album: album.URL, Path: path}
+			logAt(levelNormal, e, "    %s: metadata changed", path)
+			emit(e)
+			if keepTimes && !dry {
+				if err := setFileTime(fullpath, image); err != nil {
+					return err
+				}
+				if info, err := store.Stat(fullpath); err == nil {
+					cache.record(path, info, localSum)
+				}
+			}
+		}
+		return nil
 	}
-	log.Printf("Logged in %s, NickName is %s", email, c.NickName)
 
-	// get full list of albums
-	albums, err := c.Albums(c.NickName)
-	if err != nil {
-		log.Fatalf("Albums error: %v", err)
+	if dry {
+		if verbose {
+			logEvent(event{Event: "download", Album: album.URL, Path: path, Bytes: int64(image.Size), Reason: "dry run"},
+				"    %s: dry run, no downloading %s", path, changed)
+		}
+		plan.download(int64(image.Size), changed == "(new file)")
+		stats.Lock()
+		stats.downloaded++
+		stats.Unlock()
+		atomic.AddInt64(&totalBytes, int64(image.Size))
+		atomic.AddInt64(&fileCount, 1)
+		return nil
 	}
-	log.Printf("Found %d albums", len(albums))
 
-	// process each album
-	rate := make(chan struct{}, jobs)
-	for _, album := range albums {
-		rate <- struct{}{}
-		go func(album *smugmug.AlbumInfo) {
-			if err := processAlbum(c, album); err != nil {
-				log.Fatalf("Error processing album %s: %v", album.URL, err)
+	// after an interrupt, downloads in progress finish but no more start
+	if ctx.Err() != nil {
+		return errInterrupted
+	}
+
+	// a file renamed on the server can be renamed here as well
+	stats.Lock()
+	old := renameOrphan(path, fullpath, image, localFiles, stats)
+	stats.Unlock()
+	if old != "" {
+		e := event{Event: "rename", Album: album.URL, Path: path, Reason: old}
+		logAt(levelNormal, e, "    %s: renamed from %s %s", path, old, changed)
+		emit(e)
+		if keepTimes {
+			if err := setFileTime(fullpath, image); err != nil {
+				return err
 			}
-			<-rate
-		}(album)
+		}
+		if info, err := store.Stat(fullpath); err == nil {
+			cache.record(path, info, image.MD5Sum)
+		}
+		stats.Lock()
+		stats.downloaded++
+		if sumsFile {
+			stats.sums[path] = image.MD5Sum
+		}
+		stats.Unlock()
+		return nil
 	}
 
-	// wait for remaining jobs to finish
-	for i := 0; i < jobs; i++ {
-		rate <- struct{}{}
+	// reuse an identical file from another album if we can
+	if source := linkDuplicate(path, fullpath, image); source != "" {
+		e := event{Event: "link", Album: album.URL, Path: path, Reason: source}
+		logAt(levelNormal, e, "    %s: linked to identical file %s %s", path, source, changed)
+		emit(e)
+		if info, err := store.Stat(fullpath); err == nil {
+			cache.record(path, info, image.MD5Sum)
+		}
+		stats.Lock()
+		stats.downloaded++
+		if sumsFile {
+			stats.sums[path] = image.MD5Sum
+		}
+		stats.Unlock()
+		return nil
 	}
 
-	if totalBytes > 1024*1024 {
-		log.Printf("Downloaded %d files (%.1fm) in %v", fileCount, float64(totalBytes)/(1024*1024), time.Since(start))
-	} else if totalBytes > 1024 {
-		log.Printf("Downloaded %d files (%.1fk) in %v", fileCount, float64(totalBytes)/1024, time.Since(start))
-	} else {
-		log.Printf("Downloaded %d files (%d bytes) in %v", fileCount, totalBytes, time.Since(start))
+	url, original, err := downloadURL(image)
+	if err != nil {
+		return err
+	}
+	if !original && !isVideo(image.Format) && imageSize == "original" {
+		logAt(levelNormal, event{}, "    %s: original is not available, downloading resized rendition", path)
+	}
+	refresh := func() (string, error) { return stats.urls.url(image) }
+	size, err := fetchFile(dl, path, fullpath, url, original, image, refresh)
+	if err != nil {
+		return err
+	}
+	e := event{Event: "download", Album: album.URL, Path: path, Bytes: size}
+	logAt(levelNormal, e, "    %s: downloaded %s %s", path, formatSize(size), changed)
+	emit(e)
+	if keepTimes {
+		if err := setFileTime(fullpath, image); err != nil {
+			return err
+		}
+	}
+	var sum string
+	if sumsFile {
+		if sum, err = hashFile(fullpath); err != nil {
+			return err
+		}
 	}
+
+	// remember the sum of the file as it is now, after any change to its timestamp
+	known := sum
+	if known == "" && verify && original && !isVideo(image.Format) {
+		known = image.MD5Sum
+	}
+	if known != "" {
+		if info, err := store.Stat(fullpath); err == nil {
+			cache.record(path, info, known)
+		}
+		dedup.add(known, path)
+	}
+
+	stats.Lock()
+	stats.downloaded++
+	stats.bytes += size
+	if sum != "" {
+		stats.sums[path] = sum
+	}
+	stats.Unlock()
+	atomic.AddInt64(&totalBytes, size)
+	atomic.AddInt64(&fileCount, 1)
+
+	return nil
 }
 
-func processAlbum(c *smugmug.Conn, album *smugmug.AlbumInfo) error {
-	path := album.Category.Name
-	if album.SubCategory != nil {
-		path = filepath.Join(path, album.SubCategory.Name)
+// setFileTime sets a downloaded file's timestamp to the image's date,
+// or when it was last updated if the date is missing.
+func setFileTime(fullpath string, image *smugmug.ImageInfo) error {
+	stamp := image.Date
+	if stamp == "" {
+		stamp = image.LastUpdated
 	}
-	path = filepath.Join(path, album.Title)
-	fullpath := filepath.Join(dir, path)
-	updated, err := time.ParseInLocation("2006-01-02 15:04:05", album.LastUpdated, time.Local)
+	when, err := parseTime(stamp)
 	if err != nil {
-		return fmt.Errorf("Unable to parse timestamp %q: %v", album.LastUpdated, err)
+		return fmt.Errorf("Unable to parse timestamp %q of image %s: %v", stamp, image.FileName, err)
+	}
+	if err := store.Chtimes(fullpath, when); err != nil {
+		return fmt.Errorf("failed to set timestamp on %s: %v", fullpath, err)
 	}
+	return nil
+}
 
-	// see if we can skip this based on a time stamp
-	if fast {
-		info, err := os.Stat(fullpath)
-		if err == nil && info.IsDir() && info.ModTime().Equal(updated) {
-			log.Printf("Skipping %s [%s], timestamp of %s matches", path, album.URL, album.LastUpdated)
-			return nil
+// download saves url to fullpath and returns the size and MD5 sum
+// of the file. If offset is greater than zero, it asks the server for
+// the rest of the file starting at offset and appends it to the
+// existing file; if the server sends the whole file instead, it
+// starts over.
+func download(ctx context.Context, url, fullpath string, offset int64) (int64, string, error) {
+	header := make(http.Header)
+	for k, v := range downloadHeader {
+		header[k] = v
+	}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := downloadWithRetry(ctx, url, header, retries)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		flags = os.O_WRONLY | os.O_APPEND
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			log.Printf("    server does not support resuming %s, starting over", url)
 		}
+		offset = 0
+	default:
+		return 0, "", &statusError{url: url, code: resp.StatusCode}
 	}
 
-	log.Printf("Processing %s [%s] (updated %s)", path, album.URL, album.LastUpdated)
+	// create the directory if necessary
+	if err = store.MkdirAll(filepath.Dir(fullpath)); err != nil {
+		return 0, "", fmt.Errorf("failed to create directory %s: %v", filepath.Dir(fullpath), err)
+	}
+	fp, err := store.OpenFile(fullpath, flags)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open %s for writing: %v", fullpath, err)
+	}
+	defer fp.Close()
 
-	// scan the local directory: map path to md5sum
-	localFiles := make(map[string]string)
-	if info, err := os.Stat(fullpath); err == nil && info.IsDir() {
-		if err := filepath.Walk(fullpath, filepath.WalkFunc(func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
+	// the MD5 sum includes any data already in the file
+	h := md5.New()
+	if offset > 0 {
+		old, err := store.Open(fullpath)
+		if err != nil {
+			return 0, "", fmt.Errorf("error opening %s: %v", fullpath, err)
+		}
+		_, err = io.CopyN(h, old, offset)
+		old.Close()
+		if err != nil {
+			return 0, "", fmt.Errorf("error reading %s: %v", fullpath, err)
+		}
+	}
 
-			suffix := path
-			if strings.HasPrefix(path, dir+"/") {
-				suffix = path[len(dir)+1:]
-			}
+	var body io.Reader = limitReader(resp.Body)
+	if resp.ContentLength > 0 {
+		name := strings.TrimSuffix(strings.TrimPrefix(fullpath, dir+"/"), partSuffix)
+		body = newProgressReader(body, name, offset, offset+resp.ContentLength)
+	}
+	size, err := io.Copy(io.MultiWriter(fp, h), body)
+	if err != nil {
+		return 0, "", fmt.Errorf("error saving file %s: %v", fullpath, err)
+	}
+	return offset + size, hex.EncodeToString(h.Sum(nil)), nil
+}
 
-			if info.IsDir() {
-				localFiles[suffix] = "directory"
-				return nil
-			}
+// hashFile returns the hex-encoded MD5 sum of a file.
+func hashFile(path string) (string, error) {
+	return hashFileWith(path, nil)
+}
 
-			// get an MD5 hash
-			h := md5.New()
-			f, err := os.Open(path)
-			if err != nil {
-				log.Printf("error opening %s: %v", path, err)
-				return err
-			}
-			defer f.Close()
-			if _, err = io.Copy(h, f); err != nil {
-				log.Printf("error reading %s: %v", path, err)
-				return err
-			}
-			sum := h.Sum(nil)
-			s := hex.EncodeToString(sum)
-			localFiles[suffix] = s
-			return nil
-		})); err != nil && err != os.ErrNotExist {
-			return fmt.Errorf("error walking local file system: %v", err)
-		}
+// localDigest returns a new hash for -hash-algo, or nil if it is md5,
+// which is always computed anyway.
+func localDigest() hash.Hash {
+	if hashAlgo == "sha256" {
+		return sha256.New()
 	}
+	return nil
+}
 
-	// get full list of images from this album
-	images, err := c.Images(album)
+// hashFileWith returns the hex-encoded MD5 sum of a file, and also
+// feeds the file to extra (if not nil) in the same pass.
+func hashFileWith(path string, extra hash.Hash) (string, error) {
+	h := md5.New()
+	var w io.Writer = h
+	if extra != nil {
+		w = io.MultiWriter(h, extra)
+	}
+	f, err := store.Open(path)
 	if err != nil {
-		return fmt.Errorf("Images error: %v", err)
+		return "", fmt.Errorf("error opening %s: %v", path, err)
 	}
+	defer f.Close()
+	if _, err = io.Copy(w, f); err != nil {
+		return "", fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	// process each image
-	for _, img := range images {
-		if err := syncFile(album, img, localFiles, dir); err != nil {
-			return fmt.Errorf("Error processing image %s from album %s in category %s: %v",
-				img.FileName, album.Title, album.Category.Name, err)
+// selectVideoURL returns the URL of the largest version of a video
+// whose resolution is at most maxRes, or the smallest version if all
+// of them are larger. A maxRes of zero or less picks the largest.
+func selectVideoURL(image *smugmug.ImageInfo, maxRes int) (string, error) {
+	ladder := []struct {
+		res int
+		url string
+	}{
+		{1920, image.Video1920URL},
+		{1280, image.Video1280URL},
+		{960, image.Video960URL},
+		{640, image.Video640URL},
+		{320, image.Video320URL},
+	}
+	smallest := ""
+	for _, rung := range ladder {
+		if rung.url == "" {
+			continue
 		}
+		if maxRes <= 0 || rung.res <= maxRes {
+			return rung.url, nil
+		}
+		smallest = rung.url
+	}
+	if smallest == "" {
+		return "", fmt.Errorf("no valid url found for video")
 	}
+	return smallest, nil
+}
 
-	// delete extra files
-	if err = cleanup(localFiles, dir); err != nil {
-		return fmt.Errorf("Error cleaning up: %v", err)
+// downloadURL picks the URL to download for an image.
+// For pictures this is the original upload, which is never cropped;
+// the resized renditions may be cropped to fit the gallery, so they
+// are only used if -resized is set. The original flag reports
+// whether the URL is for the original picture.
+func downloadURL(image *smugmug.ImageInfo) (url string, original bool, err error) {
+	if isVideo(image.Format) {
+		url, err := selectVideoURL(image, videoRes)
+		return url, false, err
+	}
+	if imageSize != "original" {
+		return selectImageURL(image, imageSizes[imageSize]), false, nil
 	}
 
-	// update the directory timestamp to match
-	if !dry {
-		if err = os.Chtimes(fullpath, updated, updated); err != nil {
-			return fmt.Errorf("failed to set timestamp on directory %s: %v", fullpath, err)
+	if image.OriginalURL != "" {
+		return image.OriginalURL, true, nil
+	}
+	if !resized {
+		return "", false, fmt.Errorf("original is not available (use -resized to download the largest rendition)")
+	}
+	for _, url := range renditions(image) {
+		if url != "" {
+			return url, false, nil
 		}
 	}
+	return "", false, fmt.Errorf("no valid url found for picture")
+}
 
-	return nil
+// imageSizes maps the -image-size names to their place in the list
+// of renditions returned by renditions, largest first.
+var imageSizes = map[string]int{"x3large": 0, "x2large": 1, "xlarge": 2, "large": 3, "medium": 4, "small": 5}
+
+func renditions(image *smugmug.ImageInfo) []string {
+	return []string{image.X3LargeURL, image.X2LargeURL, image.XLargeURL, image.LargeURL, image.MediumURL, image.SmallURL}
 }
 
-func syncFile(album *smugmug.AlbumInfo, image *smugmug.ImageInfo, localFiles map[string]string, dir string) error {
-	path := album.Category.Name
-	if album.SubCategory != nil {
-		path = filepath.Join(path, album.SubCategory.Name)
+// selectImageURL returns the URL of the rendition of a picture at the
+// given place in renditions, or the next smaller one that exists. If
+// there are none that small, it falls back to the original.
+func selectImageURL(image *smugmug.ImageInfo, size int) string {
+	for _, url := range renditions(image)[size:] {
+		if url != "" {
+			return url
+		}
 	}
-	path = filepath.Join(path, album.Title)
-	if image.FileName != "" {
-		path = filepath.Join(path, image.FileName)
-	} else {
-		path = filepath.Join(path, fmt.Sprintf("%s-%d.jpg", image.Key, image.ID))
+	return image.OriginalURL
+}
+
+// parseMaxDelete parses a -max-delete value: a count of files, a
+// percentage, or both separated by a comma. Zero means no limit.
+func parseMaxDelete(s string) (count int, pct float64, err error) {
+	for _, elt := range strings.Split(s, ",") {
+		elt = strings.TrimSpace(elt)
+		switch {
+		case elt == "":
+		case strings.HasSuffix(elt, "%"):
+			if pct, err = strconv.ParseFloat(strings.TrimSuffix(elt, "%"), 64); err != nil || pct < 0 {
+				return 0, 0, fmt.Errorf("invalid percentage %q", elt)
+			}
+		default:
+			if count, err = strconv.Atoi(elt); err != nil || count < 0 {
+				return 0, 0, fmt.Errorf("invalid count %q", elt)
+			}
+		}
+	}
+	return count, pct, nil
+}
+
+// tooManyDeletes reports whether cleanup would remove more than
+// the -ratio-guard fraction of the files that were in the album
+// directory before syncing, or more than -max-delete allows, which
+// usually means the album was emptied by mistake on the server or
+// the API returned a bad image list.
+func tooManyDeletes(path string, localFiles map[string]string, localCount int) bool {
+	if force || !del || localCount == 0 {
+		return false
+	}
+	extra := 0
+	for _, v := range localFiles {
+		if v != "directory" {
+			extra++
+		}
+	}
+	var limit string
+	switch {
+	case ratio > 0 && float64(extra) > ratio*float64(localCount):
+		limit = "-ratio-guard"
+	case deleteCount > 0 && extra > deleteCount:
+		limit = "-max-delete"
+	case deletePct > 0 && float64(extra)*100 > deletePct*float64(localCount):
+		limit = "-max-delete"
+	default:
+		return false
 	}
+	e := event{Event: "skip", Path: path, Reason: "too many deletes"}
+	logWarn(e, "Warning: not cleaning up %s: it would delete %d of %d local files, more than %s allows (use -force to override)", path, extra, localCount, limit)
+	emit(e)
+	return true
+}
+
+// logSkips reports whether each skipped file is logged. -verbose asks
+// for every file, so it wins over -compact-log.
+func logSkips() bool {
+	return !compact || verbosity >= levelVerbose
+}
 
+// checkFile decides whether an image needs to be downloaded, logging
+// and counting it if not. Either way, it marks the file as existing
+// on the server so cleanup leaves it alone. The caller must hold the
+// lock on stats, which also guards localFiles.
+func checkFile(album *smugmug.AlbumInfo, image *smugmug.ImageInfo, path string, localFiles map[string]string, stats *albumStats) (changed string, fetch bool) {
 	// skip based on type of file
 	if isVideo(image.Format) && !videos {
-		log.Printf("    skipping video file %s", path)
-		// mark this local file as existing on the server
-		delete(localFiles, path)
-		delete(localFiles, filepath.Dir(path))
-
-		return nil
+		skipFile(stats, localFiles, event{Album: album.URL, Path: path, Reason: "video"}, false, "    skipping video file %s", path)
+		return "", false
 	} else if !isVideo(image.Format) && !pics {
-		log.Printf("    skipping picture file %s", path)
-		// mark this local file as existing on the server
-		delete(localFiles, path)
-		delete(localFiles, filepath.Dir(path))
+		skipFile(stats, localFiles, event{Album: album.URL, Path: path, Reason: "picture"}, false, "    skipping picture file %s", path)
+		return "", false
+	}
 
-		return nil
+	// skip based on date taken, but keep any copy we already have
+	if !inDateRange(image) {
+		skipFile(stats, localFiles, event{Album: album.URL, Path: path, Reason: "out of date range"}, false,
+			"    skipping file taken outside -min-date/-max-date %s", path)
+		return "", false
 	}
 
-	if localFiles[path] == image.MD5Sum {
-		log.Printf("    skipping unchanged file %s", path)
+	// with -new-only, any existing file counts as up to date
+	if newOnly {
+		if _, err := store.Stat(filepath.Join(dir, path)); err == nil {
+			skipFile(stats, localFiles, event{Album: album.URL, Path: path, Reason: "exists"}, true, "    skipping existing file %s", path)
+			return "", false
+		}
+	}
 
-		// mark this local file as existing on the server
-		delete(localFiles, path)
-		delete(localFiles, filepath.Dir(path))
+	// skip based on size, but keep any copy we already have
+	if sizeLimit > 0 && int64(image.Size) > sizeLimit {
+		skipFile(stats, localFiles, event{Album: album.URL, Path: path, Bytes: int64(image.Size), Reason: "too large"}, false,
+			"    skipping large file %s (%s)", path, formatSize(int64(image.Size)))
+		return "", false
+	}
 
-		return nil
+	if localFiles[path] == image.MD5Sum {
+		skipFile(stats, localFiles, event{Album: album.URL, Path: path, Reason: "unchanged"}, true, "    skipping unchanged file %s", path)
+		return "", false
 	}
 
 	if localFiles[path] != "" && isVideo(image.Format) {
-		log.Printf("    skipping existing video (assuming unchanged) %s", path)
-
-		// mark this local file as existing on the server
-		delete(localFiles, path)
-		delete(localFiles, filepath.Dir(path))
+		skipFile(stats, localFiles, event{Album: album.URL, Path: path, Reason: "existing video"}, true,
+			"    skipping existing video (assuming unchanged) %s", path)
+		return "", false
+	}
 
-		return nil
+	// a resized rendition never matches the original's MD5 sum
+	if localFiles[path] != "" && imageSize != "original" {
+		skipFile(stats, localFiles, event{Album: album.URL, Path: path, Reason: "existing rendition"}, true,
+			"    skipping existing %s rendition (assuming unchanged) %s", imageSize, path)
+		return "", false
 	}
 
 	// file is new/changed, so download it
-	fullpath := filepath.Join(dir, path)
-
-	changed := "(new file)"
+	changed = "(new file)"
 	if localFiles[path] != "" {
 		changed = "(file changed)"
 	}
 
 	// mark this local file as existing on the server
-	delete(localFiles, path)
-	delete(localFiles, filepath.Dir(path))
+	keep(localFiles, path)
 
-	if dry {
-		log.Printf("    %s: dry run, no downloading %s", path, changed)
-		totalBytes += image.Size
-		fileCount++
-		return nil
-	}
+	return changed, true
+}
 
-	url := image.OriginalURL
-	if isVideo(image.Format) {
-		if image.Video1920URL != "" {
-			url = image.Video1920URL
-		} else if image.Video1280URL != "" {
-			url = image.Video1280URL
-		} else if image.Video960URL != "" {
-			url = image.Video960URL
-		} else if image.Video640URL != "" {
-			url = image.Video640URL
-		} else if image.Video320URL != "" {
-			url = image.Video320URL
-		} else {
-			return fmt.Errorf("no valid url found for video")
-		}
+// skipFile logs, counts, and reports an image that checkFile decided
+// not to download, counting it as unchanged or as skipped. Any local
+// copy is kept: its sum is recorded and it is marked as existing on
+// the server so cleanup leaves it alone.
+func skipFile(stats *albumStats, localFiles map[string]string, e event, unchanged bool, format string, args ...interface{}) {
+	e.Event = "skip"
+	if logSkips() {
+		logAt(levelVerbose, e, format, args...)
 	}
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("error downloading %s: %v", url, err)
+	if unchanged {
+		stats.unchanged++
+	} else {
+		stats.skipped++
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code downloading %s: %d", url, resp.StatusCode)
+	if sum := localFiles[e.Path]; sum != "" {
+		stats.sums[e.Path] = sum
 	}
+	emit(e)
+	keep(localFiles, e.Path)
+}
 
-	// create the directory if necessary
-	if err = os.MkdirAll(filepath.Dir(fullpath), 0755); err != nil {
-		return fmt.Errorf("failed to create directory %s: %v", filepath.Dir(fullpath), err)
-	}
-	fp, err := os.Create(fullpath)
-	if err != nil {
-		return fmt.Errorf("failed to open %s for writing: %v", fullpath, err)
+// inDateRange reports whether an image was taken within -min-date and
+// -max-date. Images with no date taken are always in range.
+func inDateRange(image *smugmug.ImageInfo) bool {
+	if minDate.IsZero() && maxDate.IsZero() {
+		return true
 	}
-	defer fp.Close()
-	size, err := io.Copy(fp, resp.Body)
+	when, err := parseTime(image.Date)
 	if err != nil {
-		return fmt.Errorf("error saving file %s: %v", fullpath, err)
-	}
-	if int(size) != image.Size && !isVideo(image.Format) {
-		return fmt.Errorf("downloaded %d bytes from %s, expected %d", size, url, image.Size)
-	}
-	if size > 1024*1024 {
-		log.Printf("    %s: downloaded %.1fm %s", path, float64(size)/(1024*1024), changed)
-	} else if size > 1024 {
-		log.Printf("    %s: downloaded %.1fk %s", path, float64(size)/1024, changed)
-	} else {
-		log.Printf("    %s: downloaded %d bytes %s", path, size, changed)
+		return true
 	}
-	totalBytes += int(size)
-	fileCount++
-
-	return nil
+	return !when.Before(minDate) && (maxDate.IsZero() || when.Before(maxDate))
 }
 
-func cleanup(localFiles map[string]string, dir string) error {
+func cleanup(localFiles map[string]string, dir string, stats *albumStats) error {
 	if !del {
 		return nil
 	}
@@ -326,12 +2143,17 @@ func cleanup(localFiles map[string]string, dir string) error {
 			continue
 		}
 		if dry {
-			log.Printf("dry run, not removing file %s", k)
+			if verbose {
+				logEvent(event{Event: "delete", Path: k, Reason: "dry run"}, "dry run, not removing file %s", k)
+			}
+			plan.remove(false)
 		} else {
 			fullpath := filepath.Join(dir, k)
-			if err := os.Remove(fullpath); err != nil {
+			if err := store.Remove(fullpath); err != nil {
 				return fmt.Errorf("error removing file %s: %v", fullpath, err)
 			}
+			cache.forget(k)
+			emit(event{Event: "delete", Path: k})
 		}
 	}
 
@@ -341,17 +2163,22 @@ func cleanup(localFiles map[string]string, dir string) error {
 			continue
 		}
 		if dry {
-			log.Printf("dry run, not removing directory %s", k)
+			if verbose {
+				logEvent(event{Event: "delete", Path: k, Reason: "dry run"}, "dry run, not removing directory %s", k)
+			}
+			plan.remove(true)
 		} else {
 			fullpath := filepath.Join(dir, k)
-			if err := os.Remove(fullpath); err != nil {
+			if err := store.Remove(fullpath); err != nil {
 				return fmt.Errorf("error removing directory %s: %v", fullpath, err)
 			}
+			emit(event{Event: "delete", Path: k})
 		}
 	}
 
-	if len(localFiles) > 0 {
-		log.Printf("removed %d files and directories", len(localFiles))
+	stats.deleted = len(localFiles)
+	if len(localFiles) > 0 && !compact {
+		logAt(levelNormal, event{}, "removed %d files and directories", len(localFiles))
 	}
 
 	return nil
@@ -360,12 +2187,15 @@ func cleanup(localFiles map[string]string, dir string) error {
 // configString sets a config variable with a string value
 // in ascending priority:
 // 1. Default value passed in
-// 2. Environment variable value (name in upper case)
-// 3. Command-line argument (parameters mimic flag.StringVar)
+// 2. Value from the -config file, then the -json-config file (see applyConfig)
+// 3. Environment variable value (see envName)
+// 4. Contents of the file named by the NAME_FILE variable (see envString)
+// 5. Command-line argument (parameters mimic flag.StringVar)
 func configString(p *string, name, value, usage string) {
-	if s := os.Getenv(strings.ToUpper(name)); s != "" {
+	if s := envString(name); s != "" {
 		// set it to environment value if available
 		*p = s
+		fromEnv[name] = true
 	} else {
 		// fall back to default
 		*p = value
@@ -375,14 +2205,144 @@ func configString(p *string, name, value, usage string) {
 	flag.StringVar(p, name, *p, usage)
 }
 
-func isVideo(format string) bool {
-	switch format {
-	case "MP4", "AVI":
-		return true
-	case "JPG", "PNG", "GIF":
-		return false
-	default:
-		log.Fatalf("unknown image format: %s", format)
+// envString returns the environment value of a string option. If the
+// variable with _FILE appended is set, it names a file holding the
+// value, which wins over the plain variable. A trailing newline in
+// the file is ignored.
+func envString(name string) string {
+	if file := os.Getenv(envName(name) + "_FILE"); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			fatalf("Unable to read %s named by environment variable %s_FILE: %v", file, envName(name), err)
+		}
+		return strings.TrimRight(string(data), "\r\n")
 	}
-	return false
+	return os.Getenv(envName(name))
+}
+
+// configBool is like configString but for boolean values.
+func configBool(p *bool, name string, value bool, usage string) {
+	*p = value
+	if s := os.Getenv(envName(name)); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			fatalf("Invalid boolean value %q for environment variable %s", s, envName(name))
+		}
+		*p = b
+		fromEnv[name] = true
+	}
+	flag.BoolVar(p, name, *p, usage)
+}
+
+// configInt is like configString but for integer values.
+func configInt(p *int, name string, value int, usage string) {
+	*p = value
+	if s := os.Getenv(envName(name)); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			fatalf("Invalid integer value %q for environment variable %s", s, envName(name))
+		}
+		*p = n
+		fromEnv[name] = true
+	}
+	flag.IntVar(p, name, *p, usage)
+}
+
+// configFloat is like configString but for floating point values.
+func configFloat(p *float64, name string, value float64, usage string) {
+	*p = value
+	if s := os.Getenv(envName(name)); s != "" {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			fatalf("Invalid number %q for environment variable %s", s, envName(name))
+		}
+		*p = f
+		fromEnv[name] = true
+	}
+	flag.Float64Var(p, name, *p, usage)
+}
+
+// configDuration is like configString but for time.Duration values.
+func configDuration(p *time.Duration, name string, value time.Duration, usage string) {
+	*p = value
+	if s := os.Getenv(envName(name)); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			fatalf("Invalid duration %q for environment variable %s", s, envName(name))
+		}
+		*p = d
+		fromEnv[name] = true
+	}
+	flag.DurationVar(p, name, *p, usage)
+}
+
+// defaultConfigFile returns the config file that is read if it exists
+// and -config is not given.
+func defaultConfigFile() string {
+	confDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(confDir, "smugsync", "config.toml")
+}
+
+// stringList is a flag value that collects comma-separated
+// values across repeated uses of the flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	for _, elt := range strings.Split(s, ",") {
+		if elt = strings.TrimSpace(elt); elt != "" {
+			*l = append(*l, elt)
+		}
+	}
+	return nil
+}
+
+// listFlag sets a stringList from the command line or a config file.
+// The first value replaces what the list held before, such as values
+// from the environment, so each source overrides the ones below it as
+// other options do; repeated uses of the flag then add to the list.
+type listFlag struct {
+	list     *stringList
+	replaced bool
+}
+
+func (f *listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return f.list.String()
+}
+
+func (f *listFlag) Set(s string) error {
+	if !f.replaced {
+		*f.list = nil
+		f.replaced = true
+	}
+	return f.list.Set(s)
+}
+
+// reset makes the next Set replace the list again.
+func (f *listFlag) reset() {
+	f.replaced = false
+}
+
+// configList is like configString but for a list of values.
+func configList(p *stringList, name, usage string) {
+	if s := os.Getenv(envName(name)); s != "" {
+		p.Set(s)
+		fromEnv[name] = true
+	}
+	flag.Var(&listFlag{list: p}, name, usage)
+}
+
+// envName returns the environment variable name for a flag:
+// upper case, with dashes replaced by underscores.
+func envName(name string) string {
+	return strings.ToUpper(strings.Replace(name, "-", "_", -1))
 }
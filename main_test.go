@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/russross/smugmug"
+)
+
+// TestSyncFile checks what syncFile does with an image depending on
+// the local copy and the settings: download it, or leave it alone.
+func TestSyncFile(t *testing.T) {
+	server := []byte("the picture on the server")
+	tests := []struct {
+		name     string
+		format   string
+		local    []byte // nil for no local copy
+		settings func()
+		fetch    bool
+		result   func(*albumStats) int
+	}{
+		{"new", "JPG", nil, nil, true, func(s *albumStats) int { return s.downloaded }},
+		{"changed", "JPG", []byte("an older edit"), nil, true, func(s *albumStats) int { return s.downloaded }},
+		{"unchanged", "JPG", server, nil, false, func(s *albumStats) int { return s.unchanged }},
+		{"existing video", "MP4", []byte("a video"), nil, false, func(s *albumStats) int { return s.unchanged }},
+		{"new video", "MP4", nil, nil, true, func(s *albumStats) int { return s.downloaded }},
+		{"videos off", "MP4", nil, func() { videos = false }, false, func(s *albumStats) int { return s.skipped }},
+		{"pictures off", "JPG", nil, func() { pics = false }, false, func(s *albumStats) int { return s.skipped }},
+		{"too large", "JPG", nil, func() { sizeLimit = 5 }, false, func(s *albumStats) int { return s.skipped }},
+		{"too large but kept", "JPG", []byte("an older edit"), func() { sizeLimit = 5 }, false, func(s *albumStats) int { return s.skipped }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeSmug()
+			setup(t, f)
+			if test.settings != nil {
+				test.settings()
+			}
+			album := f.addAlbum("Travel", "Paris")
+			image := f.addImage(album, "IMG_0001.jpg", test.format, server)
+			path, err := imagePath(album, image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			localFiles := map[string]string{filepath.Dir(path): "directory"}
+			if test.local != nil {
+				writeFile(t, path, test.local)
+				localFiles[path] = md5Hex(test.local)
+			}
+			stats := &albumStats{sums: make(map[string]string), urls: &freshURLs{c: f, album: album}}
+
+			ctx := context.Background()
+			if err := syncFile(ctx, ctx, album, image, path, localFiles, dir, stats); err != nil {
+				t.Fatalf("syncFile: %v", err)
+			}
+
+			url := "https://photos.fake/" + image.Key
+			if got := f.content.requests(url) > 0; got != test.fetch {
+				t.Errorf("downloaded = %v, want %v", got, test.fetch)
+			}
+			want := test.local
+			if test.fetch {
+				want = server
+			}
+			if got := readFile(t, path); !bytes.Equal(got, want) {
+				t.Errorf("local file is %q, want %q", got, want)
+			}
+			if n := test.result(stats); n != 1 {
+				t.Errorf("counted %d times in the expected category, want 1 (%+v)", n, stats)
+			}
+			if _, present := localFiles[path]; present {
+				t.Errorf("%s was left for cleanup", path)
+			}
+			if _, present := localFiles[filepath.Dir(path)]; present {
+				t.Errorf("album directory was left for cleanup")
+			}
+		})
+	}
+}
+
+// TestCleanup checks that cleanup removes exactly the files and
+// directories left in localFiles, and only when it should.
+func TestCleanup(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings func()
+		removed  bool
+	}{
+		{"delete", nil, true},
+		{"no delete", func() { del = false }, false},
+		{"dry run", func() { dry = true }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setup(t, nil)
+			if test.settings != nil {
+				test.settings()
+			}
+			writeFile(t, "Travel/Paris/keep.jpg", []byte("keep"))
+			writeFile(t, "Travel/Paris/extra.jpg", []byte("extra"))
+			if err := os.MkdirAll(filepath.Join(dir, "Travel/Paris/old"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			// what is left after syncing: the extra file and the unused directory
+			localFiles := map[string]string{
+				"Travel/Paris/extra.jpg": md5Hex([]byte("extra")),
+				"Travel/Paris/old":       "directory",
+			}
+			stats := &albumStats{sums: make(map[string]string)}
+			if err := cleanup(localFiles, dir, stats); err != nil {
+				t.Fatalf("cleanup: %v", err)
+			}
+
+			if readFile(t, "Travel/Paris/keep.jpg") == nil {
+				t.Errorf("keep.jpg was removed")
+			}
+			if got := readFile(t, "Travel/Paris/extra.jpg") == nil; got != test.removed {
+				t.Errorf("extra.jpg removed = %v, want %v", got, test.removed)
+			}
+			_, err := os.Stat(filepath.Join(dir, "Travel/Paris/old"))
+			if got := os.IsNotExist(err); got != test.removed {
+				t.Errorf("old directory removed = %v, want %v", got, test.removed)
+			}
+		})
+	}
+}
+
+func TestParseMaxDelete(t *testing.T) {
+	tests := []struct {
+		in    string
+		count int
+		pct   float64
+	}{
+		{"", 0, 0},
+		{"0", 0, 0},
+		{"10", 10, 0},
+		{"5%", 0, 5},
+		{"10, 2.5%", 10, 2.5},
+		{"2.5%,10", 10, 2.5},
+	}
+	for _, test := range tests {
+		count, pct, err := parseMaxDelete(test.in)
+		if err != nil {
+			t.Errorf("parseMaxDelete(%q): %v", test.in, err)
+		} else if count != test.count || pct != test.pct {
+			t.Errorf("parseMaxDelete(%q) = %d, %v, want %d, %v", test.in, count, pct, test.count, test.pct)
+		}
+	}
+	for _, in := range []string{"-1", "ten", "-5%", "x%", "1.5"} {
+		if _, _, err := parseMaxDelete(in); err == nil {
+			t.Errorf("parseMaxDelete(%q) succeeded", in)
+		}
+	}
+}
+
+// TestTooManyDeletes checks the -max-delete and -ratio-guard limits on
+// cleanup, including an album that is empty on the server.
+func TestTooManyDeletes(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings func()
+		extra    int
+		want     bool
+	}{
+		{"no limits", nil, 10, false},
+		{"under count", func() { deleteCount = 3 }, 3, false},
+		{"over count", func() { deleteCount = 3 }, 4, true},
+		{"under percentage", func() { deletePct = 30 }, 3, false},
+		{"over percentage", func() { deletePct = 30 }, 4, true},
+		{"under ratio", func() { ratio = 0.5 }, 5, false},
+		{"over ratio", func() { ratio = 0.5 }, 6, true},
+		{"empty on the server", func() { deleteCount = 3 }, 10, true},
+		{"empty on the server with -force", func() { deleteCount, force = 3, true }, 10, false},
+		{"no -delete", func() { deleteCount, del = 3, false }, 10, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setup(t, nil)
+			if test.settings != nil {
+				test.settings()
+			}
+			// ten files before syncing, of which extra are left over;
+			// directories do not count
+			localFiles := map[string]string{"Travel/Paris/old": "directory"}
+			for i := 0; i < test.extra; i++ {
+				localFiles[fmt.Sprintf("Travel/Paris/IMG_%04d.jpg", i)] = "0123456789abcdef0123456789abcdef"
+			}
+			if got := tooManyDeletes("Travel/Paris", localFiles, 10); got != test.want {
+				t.Errorf("tooManyDeletes with %d of 10 files left over = %v, want %v", test.extra, got, test.want)
+			}
+		})
+	}
+
+	// nothing to compare against in an album that had no local files
+	setup(t, nil)
+	deleteCount = 1
+	if tooManyDeletes("Travel/Paris", map[string]string{}, 0) {
+		t.Errorf("tooManyDeletes with no local files = true, want false")
+	}
+}
+
+// TestSyncConcurrent syncs several albums at once, with several
+// downloads in each, and checks the files and the shared counters.
+// Run it with -race.
+func TestSyncConcurrent(t *testing.T) {
+	f := newFakeSmug()
+	setup(t, f)
+	jobs, fileJobs = 4, 3
+
+	var want int64
+	for i := 0; i < 6; i++ {
+		album := f.addAlbum("Travel", fmt.Sprintf("Trip %d", i))
+		for j := 0; j < 5; j++ {
+			data := []byte(fmt.Sprintf("album %d image %d", i, j))
+			f.addImage(album, fmt.Sprintf("IMG_%04d.jpg", j), "JPG", data)
+			want += int64(len(data))
+		}
+	}
+
+	result := syncAccount(context.Background(), &account{provider: fakeAuth{f}})
+	if len(result.failures) > 0 {
+		t.Fatalf("failures: %v", result.failures)
+	}
+	if result.files != 30 || result.bytes != want {
+		t.Errorf("downloaded %d files (%d bytes), want 30 (%d bytes)", result.files, result.bytes, want)
+	}
+	if result.completed != 6 {
+		t.Errorf("completed %d albums, want 6", result.completed)
+	}
+	for _, album := range f.albums {
+		for _, image := range f.images[album] {
+			path, err := imagePath(album, image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := md5Hex(readFile(t, path)); got != image.MD5Sum {
+				t.Errorf("%s has MD5 sum %s, want %s", path, got, image.MD5Sum)
+			}
+		}
+	}
+}
+
+// TestCategories checks that albums with no category, or a blank one,
+// are stored under -uncategorized and synced like any other.
+func TestCategories(t *testing.T) {
+	f := newFakeSmug()
+	setup(t, f)
+	missing := f.addAlbum("", "Loose")
+	blank := f.addAlbum("", "Blank")
+	blank.Category = &smugmug.CategoryInfo{Name: "  "}
+	sub := f.addAlbum("", "Sub only")
+	sub.SubCategory = &smugmug.CategoryInfo{Name: "Kids"}
+	filed := f.addAlbum("Travel", "Paris")
+
+	tests := []struct {
+		album *smugmug.AlbumInfo
+		want  string
+	}{
+		{missing, "Uncategorized/Loose"},
+		{blank, "Uncategorized/Blank"},
+		{sub, "Uncategorized/Kids/Sub only"},
+		{filed, "Travel/Paris"},
+	}
+	for _, test := range tests {
+		if got := filepath.ToSlash(albumPath(test.album)); got != test.want {
+			t.Errorf("albumPath(%q) = %q, want %q", test.album.Title, got, test.want)
+		}
+	}
+
+	image := f.addImage(missing, "IMG_0001.jpg", "JPG", []byte("uncategorized"))
+	result := syncAccount(context.Background(), &account{provider: fakeAuth{f}})
+	if len(result.failures) > 0 {
+		t.Fatalf("failures: %v", result.failures)
+	}
+	if got := readFile(t, "Uncategorized/Loose/IMG_0001.jpg"); md5Hex(got) != image.MD5Sum {
+		t.Errorf("uncategorized image was not synced")
+	}
+}
+
+// TestAlbumTitle checks that albums with blank titles get directories
+// of their own, named the same way on every run.
+func TestAlbumTitle(t *testing.T) {
+	f := newFakeSmug()
+	setup(t, f)
+	empty := f.addAlbum("Travel", "")
+	spaces := f.addAlbum("Travel", " \t ")
+	noKey := f.addAlbum("Travel", "")
+	noKey.Key = ""
+	titled := f.addAlbum("Travel", "Paris")
+
+	tests := []struct {
+		album *smugmug.AlbumInfo
+		want  string
+	}{
+		{empty, "Travel/" + empty.Key},
+		{spaces, "Travel/" + spaces.Key},
+		{noKey, fmt.Sprintf("Travel/album-%d", noKey.ID)},
+		{titled, "Travel/Paris"},
+	}
+	seen := make(map[string]bool)
+	for _, test := range tests {
+		got := filepath.ToSlash(albumPath(test.album))
+		if got != test.want {
+			t.Errorf("albumPath(%q) = %q, want %q", test.album.Title, got, test.want)
+		}
+		if again := filepath.ToSlash(albumPath(test.album)); again != got {
+			t.Errorf("albumPath(%q) changed from %q to %q", test.album.Title, got, again)
+		}
+		if seen[got] {
+			t.Errorf("more than one album is stored in %s", got)
+		}
+		seen[got] = true
+	}
+}
+
+// TestAlbumPathCollision checks that albums whose titles are the same
+// once sanitized, or differ only in case, are refused rather than
+// synced into one directory.
+func TestAlbumPathCollision(t *testing.T) {
+	tests := []struct {
+		first, second string
+	}{
+		{"Trip: Paris", "Trip/ Paris"},
+		{"Trip.", "Trip_"},
+		{"Paris", "PARIS"},
+	}
+	for _, test := range tests {
+		f := newFakeSmug()
+		setup(t, f)
+		first := f.addAlbum("Travel", test.first)
+		second := f.addAlbum("Travel", test.second)
+		f.addImage(first, "IMG_0001.jpg", "JPG", []byte("tower"))
+		f.addImage(second, "IMG_0002.jpg", "JPG", []byte("louvre"))
+
+		result := syncAccount(context.Background(), &account{provider: fakeAuth{f}})
+		if len(result.failures) != 1 || !strings.Contains(result.failures[0], second.URL) {
+			t.Errorf("%q and %q: failures = %q, want a collision", test.first, test.second, result.failures)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "Travel", sanitizeName(test.first))); err == nil {
+			t.Errorf("%q and %q: album directory was created despite the collision", test.first, test.second)
+		}
+	}
+}
+
+// TestSharedLayoutCollisions checks that images with the same name in
+// different albums are kept apart when albums share directories.
+func TestSharedLayoutCollisions(t *testing.T) {
+	for _, mode := range []string{"flat", "date"} {
+		t.Run(mode, func(t *testing.T) {
+			f := newFakeSmug()
+			setup(t, f)
+			layout = mode
+			first := f.addAlbum("Travel", "Paris")
+			second := f.addAlbum("Travel", "Rome")
+			a := f.addImage(first, "IMG_0001.jpg", "JPG", []byte("tower"))
+			b := f.addImage(second, "IMG_0001.jpg", "JPG", []byte("colosseum"))
+			a.Date, b.Date = "2020-01-02 03:04:05", "2020-01-02 03:04:05"
+			shared := f.addImage(second, "IMG_0002.jpg", "JPG", []byte("both"))
+			f.images[first] = append(f.images[first], shared)
+
+			result := syncAccount(context.Background(), &account{provider: fakeAuth{f}})
+			if len(result.failures) > 0 {
+				t.Fatalf("failures: %v", result.failures)
+			}
+			seen := make(map[string]*smugmug.ImageInfo)
+			for _, album := range []*smugmug.AlbumInfo{first, second} {
+				paths, err := claimPaths(album, f.images[album])
+				if err != nil {
+					t.Fatal(err)
+				}
+				for image, path := range paths {
+					if other := seen[path]; other != nil && other != image {
+						t.Errorf("%s and %s are both stored in %s", other.Key, image.Key, path)
+					}
+					seen[path] = image
+					if got := md5Hex(readFile(t, path)); got != image.MD5Sum {
+						t.Errorf("%s has MD5 sum %s, want %s", path, got, image.MD5Sum)
+					}
+				}
+			}
+			if len(seen) != 3 {
+				t.Errorf("images stored in %d paths, want 3", len(seen))
+			}
+		})
+	}
+}
+
+// TestProgressListingFailure checks that with -progress, an album whose
+// images cannot be listed fails on its own and the rest still sync.
+func TestProgressListingFailure(t *testing.T) {
+	f := newFakeSmug()
+	setup(t, f)
+	progress = true
+	bad := f.addAlbum("Travel", "Paris")
+	good := f.addAlbum("Travel", "Rome")
+	f.addImage(bad, "IMG_0001.jpg", "JPG", []byte("tower"))
+	image := f.addImage(good, "IMG_0002.jpg", "JPG", []byte("colosseum"))
+	f.broken[bad] = errors.New("malformed response")
+
+	result := syncAccount(context.Background(), &account{provider: fakeAuth{f}})
+	if len(result.failures) != 1 || !strings.Contains(result.failures[0], bad.URL) {
+		t.Errorf("failures = %q, want one for %s", result.failures, bad.URL)
+	}
+	if result.completed != 1 {
+		t.Errorf("completed %d albums, want 1", result.completed)
+	}
+	path, err := imagePath(good, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := md5Hex(readFile(t, path)); got != image.MD5Sum {
+		t.Errorf("%s has MD5 sum %s, want %s", path, got, image.MD5Sum)
+	}
+}
+
+// TestScheduleBySize checks that -smart-schedule with -progress orders
+// albums by the bytes they hold rather than by how many images.
+func TestScheduleBySize(t *testing.T) {
+	f := newFakeSmug()
+	setup(t, f)
+	many := f.addAlbum("Travel", "Snapshots")
+	for i := 0; i < 5; i++ {
+		f.addImage(many, fmt.Sprintf("IMG_%04d.jpg", i), "JPG", []byte("small"))
+	}
+	few := f.addAlbum("Travel", "Panoramas")
+	f.addImage(few, "PANO_0001.jpg", "JPG", bytes.Repeat([]byte("wide"), 100))
+
+	albums := []*smugmug.AlbumInfo{many, few}
+	lists := []*imageList{fetchImages(context.Background(), f, many), fetchImages(context.Background(), f, few)}
+	unlisted := []bool{false, true}
+	scheduleBySize(albums, lists, unlisted)
+	if albums[0] != few || albums[1] != many {
+		t.Errorf("scheduled %s before %s, want the larger album first", albums[0].Title, albums[1].Title)
+	}
+	if images, _ := lists[0].wait(); len(images) != 1 || !unlisted[0] {
+		t.Errorf("lists and unlisted were not reordered with the albums")
+	}
+}
+
+func TestSelectVideoURL(t *testing.T) {
+	all := &smugmug.ImageInfo{
+		Video1920URL: "v1920", Video1280URL: "v1280", Video960URL: "v960",
+		Video640URL: "v640", Video320URL: "v320",
+	}
+	gaps := &smugmug.ImageInfo{Video1280URL: "v1280", Video640URL: "v640"}
+	tests := []struct {
+		image  *smugmug.ImageInfo
+		maxRes int
+		want   string
+	}{
+		{all, 0, "v1920"},
+		{all, 960, "v960"},
+		{all, 320, "v320"},
+		{gaps, 960, "v640"},
+		{gaps, 1920, "v1280"},
+		{all, 240, "v320"},
+		{gaps, 480, "v640"},
+	}
+	for _, test := range tests {
+		got, err := selectVideoURL(test.image, test.maxRes)
+		if err != nil {
+			t.Errorf("selectVideoURL(%d): %v", test.maxRes, err)
+		} else if got != test.want {
+			t.Errorf("selectVideoURL(%d) = %q, want %q", test.maxRes, got, test.want)
+		}
+	}
+	if got, err := selectVideoURL(&smugmug.ImageInfo{}, 0); err == nil {
+		t.Errorf("selectVideoURL with no versions = %q, want an error", got)
+	}
+}
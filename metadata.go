@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/russross/smugmug"
+)
+
+// albumMetadataName is the file in each album directory
+// that holds album metadata when -album-metadata is set.
+const albumMetadataName = "album.json"
+
+type albumMetadata struct {
+	Title       string `json:"title"`
+	Category    string `json:"category"`
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url"`
+	ImageCount  int    `json:"imageCount"`
+	LastUpdated string `json:"lastUpdated"`
+}
+
+// writeAlbumMetadata writes album.json into the album directory
+// and marks it as expected so cleanup leaves it alone.
+func writeAlbumMetadata(album *smugmug.AlbumInfo, localFiles map[string]string, dir string) error {
+	path := filepath.Join(albumPath(album), albumMetadataName)
+	keep(localFiles, path)
+
+	meta := &albumMetadata{
+		Title:       album.Title,
+		Category:    strings.Join(categories(album), "/"),
+		Description: album.Description,
+		URL:         album.URL,
+		ImageCount:  album.ImageCount,
+		LastUpdated: album.LastUpdated,
+	}
+	data, err := json.MarshalIndent(meta, "", "    ")
+	if err != nil {
+		return fmt.Errorf("error encoding album metadata: %v", err)
+	}
+	data = append(data, '\n')
+
+	fullpath := filepath.Join(dir, path)
+	if old, err := store.ReadFile(fullpath); err == nil && string(old) == string(data) {
+		return nil
+	}
+	if dry {
+		log.Printf("    %s: dry run, not writing album metadata", path)
+		return nil
+	}
+	if err := store.MkdirAll(filepath.Dir(fullpath)); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", filepath.Dir(fullpath), err)
+	}
+	if err := store.WriteFile(fullpath, data); err != nil {
+		return fmt.Errorf("failed to write %s: %v", fullpath, err)
+	}
+	log.Printf("    %s: wrote album metadata", path)
+	return nil
+}
+
+// emptyMarkerName is the file written into the directory of an album
+// with no images when -empty-album-marker is set, so the album's
+// existence is recorded locally.
+const emptyMarkerName = ".empty"
+
+// writeEmptyMarker creates the album directory with an empty marker
+// file in it, and marks the marker as expected so cleanup leaves it
+// alone. Once the album has images, cleanup removes the marker.
+func writeEmptyMarker(album *smugmug.AlbumInfo, localFiles map[string]string, dir string) error {
+	path := filepath.Join(albumPath(album), emptyMarkerName)
+	keep(localFiles, path)
+
+	fullpath := filepath.Join(dir, path)
+	if _, err := store.Stat(fullpath); err == nil {
+		return nil
+	}
+	if dry {
+		log.Printf("    %s: dry run, not writing empty album marker", path)
+		return nil
+	}
+	if err := store.MkdirAll(filepath.Dir(fullpath)); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", filepath.Dir(fullpath), err)
+	}
+	if err := store.WriteFile(fullpath, nil); err != nil {
+		return fmt.Errorf("failed to write %s: %v", fullpath, err)
+	}
+	log.Printf("    %s: wrote empty album marker", path)
+	return nil
+}
+
+// checksumsName is the file in each album directory that lists
+// MD5 sums when -checksums is set, in the format of md5sum.
+const checksumsName = ".md5sums"
+
+// writeChecksums writes .md5sums into the album directory and marks
+// it as expected so cleanup leaves it alone. sums maps file paths
+// (relative to dir) to MD5 sums; entries are sorted by name so the
+// file only changes when the album does.
+func writeChecksums(album *smugmug.AlbumInfo, sums map[string]string, localFiles map[string]string, dir string) error {
+	// with nothing to list, let cleanup remove any old file
+	if len(sums) == 0 {
+		return nil
+	}
+	path := filepath.Join(albumPath(album), checksumsName)
+	keep(localFiles, path)
+
+	var names []string
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var data []byte
+	for _, name := range names {
+		rel, err := filepath.Rel(filepath.Dir(path), name)
+		if err != nil {
+			return fmt.Errorf("error finding relative path of %s: %v", name, err)
+		}
+		data = append(data, fmt.Sprintf("%s  %s\n", sums[name], filepath.ToSlash(rel))...)
+	}
+
+	fullpath := filepath.Join(dir, path)
+	if old, err := store.ReadFile(fullpath); err == nil && string(old) == string(data) {
+		return nil
+	}
+	if dry {
+		log.Printf("    %s: dry run, not writing checksums", path)
+		return nil
+	}
+	if err := store.WriteFile(fullpath, data); err != nil {
+		return fmt.Errorf("failed to write %s: %v", fullpath, err)
+	}
+	log.Printf("    %s: wrote checksums for %d files", path, len(names))
+	return nil
+}
+
+// manifestName is the file in each album directory that lists
+// the album's images when -manifest is set.
+const manifestName = "index.json"
+
+type manifestEntry struct {
+	FileName string `json:"fileName"`
+	Size     int    `json:"size"`
+	MD5Sum   string `json:"md5,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Key      string `json:"key"`
+}
+
+// writeManifest writes index.json into the album directory, listing
+// every image in the album sorted by file name. paths gives the local
+// path of each image (relative to dir). With -hash-algo sha256, the
+// SHA-256 digest of each local copy is included. The walk never records the
+// manifest, so cleanup leaves it alone.
+func writeManifest(album *smugmug.AlbumInfo, images []*smugmug.ImageInfo, paths map[*smugmug.ImageInfo]string, dir string) error {
+	path := filepath.Join(albumPath(album), manifestName)
+
+	entries := []manifestEntry{}
+	for _, image := range images {
+		rel, err := filepath.Rel(filepath.Dir(path), paths[image])
+		if err != nil {
+			return fmt.Errorf("error finding relative path of %s: %v", paths[image], err)
+		}
+		var digest string
+		if hashAlgo == "sha256" {
+			fullpath := filepath.Join(dir, paths[image])
+			if info, err := store.Stat(fullpath); err == nil {
+				if _, digest, err = cache.sums(paths[image], fullpath, info); err != nil {
+					return err
+				}
+			}
+		}
+		entries = append(entries, manifestEntry{
+			FileName: filepath.ToSlash(rel),
+			Size:     image.Size,
+			MD5Sum:   image.MD5Sum,
+			SHA256:   digest,
+			Key:      image.Key,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].FileName < entries[j].FileName })
+	data, err := json.MarshalIndent(entries, "", "    ")
+	if err != nil {
+		return fmt.Errorf("error encoding manifest: %v", err)
+	}
+	data = append(data, '\n')
+
+	fullpath := filepath.Join(dir, path)
+	if old, err := store.ReadFile(fullpath); err == nil && string(old) == string(data) {
+		return nil
+	}
+	if dry {
+		log.Printf("    %s: dry run, not writing manifest", path)
+		return nil
+	}
+	if err := store.MkdirAll(filepath.Dir(fullpath)); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", filepath.Dir(fullpath), err)
+	}
+	if err := store.WriteFile(fullpath, data); err != nil {
+		return fmt.Errorf("failed to write %s: %v", fullpath, err)
+	}
+	log.Printf("    %s: wrote manifest of %d images", path, len(entries))
+	return nil
+}
+
+// metadataDigest summarizes the parts of an image's metadata that can
+// change without changing the file, for -include-metadata-in-hash.
+func metadataDigest(image *smugmug.ImageInfo) string {
+	sum := md5.Sum([]byte(image.Caption + "\x00" + image.Keywords + "\x00" + image.Date))
+	return hex.EncodeToString(sum[:])
+}
+
+// keywordList splits an image's keywords, which SmugMug separates
+// with semicolons or commas.
+func keywordList(keywords string) []string {
+	var list []string
+	for _, word := range strings.FieldsFunc(keywords, func(r rune) bool { return r == ';' || r == ',' }) {
+		if word = strings.TrimSpace(word); word != "" {
+			list = append(list, word)
+		}
+	}
+	return list
+}
+
+// writeSidecar writes data to a file stored next to an image, at path
+// relative to dir, unless the existing file already has the same
+// contents. It marks the file as expected so cleanup leaves it alone.
+func writeSidecar(path string, data []byte, localFiles map[string]string, dir string, stats *albumStats) error {
+	sum := md5.Sum(data)
+	stats.Lock()
+	old := localFiles[path]
+	keep(localFiles, path)
+	stats.Unlock()
+	if old == hex.EncodeToString(sum[:]) {
+		return nil
+	}
+
+	if dry {
+		log.Printf("    %s: dry run, not writing", path)
+		return nil
+	}
+	fullpath := filepath.Join(dir, path)
+	if err := store.MkdirAll(filepath.Dir(fullpath)); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", filepath.Dir(fullpath), err)
+	}
+	if err := store.WriteFile(fullpath, data); err != nil {
+		return fmt.Errorf("failed to write %s: %v", fullpath, err)
+	}
+	if !compact {
+		logAt(levelNormal, event{}, "    %s: wrote sidecar", path)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// partSuffix marks a file that is still being downloaded.
+const partSuffix = ".part"
+
+// scanParts finds leftover partial downloads and their sidecar state
+// files under dir, reports how many there are and how much space they
+// use, and if remove is set, removes the ones that can no longer be
+// resumed. A download that a later sync would pick up is left alone.
+func scanParts(dir string, remove bool) error {
+	count, size := 0, int64(0)
+	err := store.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !(strings.HasSuffix(path, partSuffix) || strings.HasSuffix(path, stateSuffix)) {
+			return nil
+		}
+		count++
+		size += info.Size()
+		if !remove {
+			log.Printf("    found partial download %s", path)
+			return nil
+		}
+		if !orphanedPart(path) {
+			log.Printf("    keeping resumable partial download %s", path)
+			return nil
+		}
+		if dry {
+			log.Printf("dry run, not removing partial download %s", path)
+			return nil
+		}
+		if err := store.Remove(path); err != nil {
+			return fmt.Errorf("error removing partial download %s: %v", path, err)
+		}
+		log.Printf("    removed partial download %s", path)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if count > 0 {
+		log.Printf("Found %d partial downloads (%d bytes)", count, size)
+	}
+	return nil
+}
+
+// orphanedPart reports whether a .part or state file is left over
+// from a download that cannot be resumed: resuming is off, or the
+// file's partner is missing or the state cannot be read. fetchFile
+// checks a resumable download against the image before using it.
+func orphanedPart(path string) bool {
+	if !resume {
+		return true
+	}
+	base := strings.TrimSuffix(path, partSuffix)
+	if strings.HasSuffix(path, stateSuffix) {
+		base = strings.TrimSuffix(path, stateSuffix)
+	}
+	if _, err := readState(base + stateSuffix); err != nil {
+		return true
+	}
+	_, err := store.Stat(base + partSuffix)
+	return err != nil
+}
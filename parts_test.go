@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// TestRemoveOrphanedParts checks that -part-files remove only removes
+// partial downloads that cannot be resumed.
+func TestRemoveOrphanedParts(t *testing.T) {
+	setup(t, nil)
+	state := []byte(`{"size":5,"md5":"0123456789abcdef0123456789abcdef","downloaded":3}` + "\n")
+	writeFile(t, "Travel/Paris/resumable.jpg.part", []byte("tow"))
+	writeFile(t, "Travel/Paris/resumable.jpg"+stateSuffix, state)
+	writeFile(t, "Travel/Paris/no-state.jpg.part", []byte("riv"))
+	writeFile(t, "Travel/Paris/no-part.jpg"+stateSuffix, state)
+	writeFile(t, "Travel/Paris/bad-state.jpg.part", []byte("bri"))
+	writeFile(t, "Travel/Paris/bad-state.jpg"+stateSuffix, []byte("{"))
+
+	if err := scanParts(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		kept bool
+	}{
+		{"Travel/Paris/resumable.jpg.part", true},
+		{"Travel/Paris/resumable.jpg" + stateSuffix, true},
+		{"Travel/Paris/no-state.jpg.part", false},
+		{"Travel/Paris/no-part.jpg" + stateSuffix, false},
+		{"Travel/Paris/bad-state.jpg.part", false},
+		{"Travel/Paris/bad-state.jpg" + stateSuffix, false},
+	}
+	for _, test := range tests {
+		if kept := readFile(t, test.path) != nil; kept != test.kept {
+			t.Errorf("%s kept = %v, want %v", test.path, kept, test.kept)
+		}
+	}
+
+	// without -resume nothing can be picked up again
+	resume = false
+	if err := scanParts(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	if readFile(t, "Travel/Paris/resumable.jpg.part") != nil {
+		t.Errorf("partial download kept with -resume=false")
+	}
+}
+
+// TestResumeRendition checks that a partial download is resumed only
+// for the rendition it was started from.
+func TestResumeRendition(t *testing.T) {
+	f := newFakeSmug()
+	setup(t, f)
+	album := f.addAlbum("Travel", "Paris")
+	data := []byte("the 320p rendition of a video")
+	image := f.addImage(album, "clip.mp4", "MP4", data)
+	refresh := func() (string, error) { return image.Video320URL, nil }
+
+	// the part file holds the start of whichever rendition it came from
+	for _, test := range []struct {
+		source, part string
+	}{
+		{image.Video320URL + "?signature=old", "the "},
+		{"https://photos.fake/" + image.Key + "/1080", "THE "},
+	} {
+		state := fmt.Sprintf(`{"size":%d,"md5":%q,"source":%q,"downloaded":4}`+"\n", image.Size, image.MD5Sum, sourceKey(test.source))
+		writeFile(t, "Travel/Paris/clip.mp4"+partSuffix, []byte(test.part))
+		writeFile(t, "Travel/Paris/clip.mp4"+stateSuffix, []byte(state))
+		fullpath := filepath.Join(dir, "Travel/Paris/clip.mp4")
+		if _, err := fetchFile(context.Background(), "Travel/Paris/clip.mp4", fullpath, image.Video320URL, false, image, refresh); err != nil {
+			t.Fatal(err)
+		}
+		if got := readFile(t, "Travel/Paris/clip.mp4"); string(got) != string(data) {
+			t.Errorf("resuming a download of %s gave %q, want %q", test.source, got, data)
+		}
+	}
+}
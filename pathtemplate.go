@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/russross/smugmug"
+)
+
+// pathTemplate is the parsed -path-template, or nil if it is not set.
+var pathTemplate *template.Template
+
+// pathFields are the values available to -path-template.
+type pathFields struct {
+	Category    string
+	SubCategory string
+	Title       string
+	FileName    string
+	DateTaken   time.Time
+	Key         string
+}
+
+// parsePathTemplate parses a -path-template value and tries it out on
+// sample values, so mistakes are reported before any work is done.
+func parsePathTemplate(s string) (*template.Template, error) {
+	tmpl, err := template.New("path").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	sample := &pathFields{
+		Category:  "Category",
+		Title:     "Album",
+		FileName:  "IMG_0001.jpg",
+		DateTaken: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		Key:       "key",
+	}
+	if _, err := renderPath(tmpl, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// renderPath fills in a path template. The result must be a relative
+// path that stays inside the target directory.
+func renderPath(tmpl *template.Template, fields *pathFields) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, fields); err != nil {
+		return "", err
+	}
+	path := filepath.Clean(filepath.FromSlash(buf.String()))
+	if path == "." || filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path template gives %q, which is not inside the target directory", buf.String())
+	}
+	return path, nil
+}
+
+// templatePath returns the path of an image's file relative to dir
+// according to -path-template. name is the image's file name.
+func templatePath(album *smugmug.AlbumInfo, image *smugmug.ImageInfo, name string) (string, error) {
+	fields := &pathFields{Title: sanitizeName(albumTitle(album)), FileName: name, Key: image.Key}
+	levels := categories(album)
+	fields.Category = sanitizeName(levels[0])
+	if len(levels) > 1 {
+		fields.SubCategory = sanitizeName(levels[1])
+	}
+	if when, err := parseTime(image.Date); err == nil {
+		fields.DateTaken = when
+	}
+	path, err := renderPath(pathTemplate, fields)
+	if err != nil {
+		return "", fmt.Errorf("error applying -path-template to %s: %v", name, err)
+	}
+	return path, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// pauseName is the control file that pauses downloads while it exists.
+const pauseName = ".smugsync-pause"
+
+// pauseInterval is how often to check whether the pause file is gone.
+const pauseInterval = 5 * time.Second
+
+// pauseDir is the directory the pause file goes in: -dir itself, even
+// when each account is synced into a subdirectory of it.
+var pauseDir string
+
+// pausedJobs counts the jobs waiting on the pause file, so the pause
+// and the resume are only logged once however many jobs notice them.
+var pausedJobs int32
+
+// waitIfPaused blocks while the pause file exists in pauseDir. It
+// returns errInterrupted if ctx is done first.
+func waitIfPaused(ctx context.Context) error {
+	name := filepath.Join(pauseDir, pauseName)
+	if _, err := store.Stat(name); err != nil {
+		return nil
+	}
+	if atomic.AddInt32(&pausedJobs, 1) == 1 {
+		log.Printf("Pausing until %s is removed", name)
+	}
+	start := clk.Now()
+	defer func() {
+		if atomic.AddInt32(&pausedJobs, -1) == 0 && ctx.Err() == nil {
+			log.Printf("Resuming after pause of %v", since(start))
+		}
+	}()
+
+	ticker := time.NewTicker(pauseInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return errInterrupted
+		case <-ticker.C:
+			if _, err := store.Stat(name); os.IsNotExist(err) {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/russross/smugmug"
+)
+
+const (
+	// progressMinSize is the smallest download that reports progress.
+	progressMinSize = 10 * 1024 * 1024
+
+	// progressInterval is how often progress is reported.
+	progressInterval = 5 * time.Second
+
+	// totalProgressInterval is how often overall progress is reported.
+	totalProgressInterval = 30 * time.Second
+)
+
+// showProgress reports whether progress lines should be printed:
+// -progress must be set, the log must go to a terminal, and only
+// one download can be running at a time so lines do not interleave.
+func showProgress() bool {
+	if !progress || jobs > 1 || fileJobs > 1 {
+		return false
+	}
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressReader counts bytes as they are read and logs
+// a progress line every progressInterval.
+type progressReader struct {
+	io.Reader
+	name  string
+	done  int64
+	total int64
+	start time.Time
+	last  time.Time
+}
+
+func newProgressReader(r io.Reader, name string, done, total int64) io.Reader {
+	if total < progressMinSize || !showProgress() {
+		return r
+	}
+	now := clk.Now()
+	return &progressReader{Reader: r, name: name, done: done, total: total, start: now, last: now}
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.Reader.Read(buf)
+	p.done += int64(n)
+	if now := clk.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		rate := float64(p.done) / now.Sub(p.start).Seconds()
+		log.Printf("    %s: %d%% (%s of %s) at %s/s",
+			p.name, p.done*100/p.total, formatSize(p.done), formatSize(p.total), formatSize(int64(rate)))
+	}
+	return n, err
+}
+
+// totalProgress counts files and bytes across all albums. Every
+// album is listed before any downloads start so the totals are known.
+// The methods do nothing on a nil receiver, which is what overall is
+// without -progress.
+type totalProgress struct {
+	sync.Mutex
+	files     int64
+	bytes     int64
+	doneFiles int64
+	doneBytes int64
+}
+
+var overall *totalProgress
+
+// expect adds an album's images to the totals.
+func (p *totalProgress) expect(images []*smugmug.ImageInfo) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	for _, image := range images {
+		p.files++
+		p.bytes += int64(image.Size)
+	}
+}
+
+// finish records that an image has been handled, whether or not
+// it needed downloading.
+func (p *totalProgress) finish(size int64) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.doneFiles++
+	p.doneBytes += size
+}
+
+// finishAll records that all of an album's images have been handled.
+func (p *totalProgress) finishAll(images []*smugmug.ImageInfo) {
+	for _, image := range images {
+		p.finish(int64(image.Size))
+	}
+}
+
+// report logs a single line of overall progress. Each line is
+// written in one call, so concurrent jobs cannot split it.
+func (p *totalProgress) report() {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	percent := int64(100)
+	if p.bytes > 0 {
+		percent = p.doneBytes * 100 / p.bytes
+	}
+	log.Printf("Progress: %d of %d files, %s of %s (%d%%)",
+		p.doneFiles, p.files, formatSize(p.doneBytes), formatSize(p.bytes), percent)
+}
+
+// formatSize formats a byte count the way the rest of the log does.
+func formatSize(n int64) string {
+	if n > 1024*1024 {
+		return fmt.Sprintf("%.1fm", float64(n)/(1024*1024))
+	} else if n > 1024 {
+		return fmt.Sprintf("%.1fk", float64(n)/1024)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
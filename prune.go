@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// pruneEmptyDirs removes empty directories under dir, deepest first,
+// so a category left empty by removing its albums goes too. dir itself
+// is never removed, and neither is any directory in keep (paths
+// relative to dir), which holds the directories of albums that still
+// exist, even if they are empty.
+func pruneEmptyDirs(keep map[string]bool) error {
+	var dirs []string
+	err := store.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != dir {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error walking local file system: %v", err)
+	}
+
+	// a dry run removes nothing, so track what would have gone
+	// to see if the parent directory would then be empty
+	removed := make(map[string]bool)
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path := dirs[i]
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || keep[rel] {
+			continue
+		}
+		entries, err := store.ReadDir(path)
+		if err != nil {
+			return fmt.Errorf("error reading directory %s: %v", path, err)
+		}
+		empty := true
+		for _, entry := range entries {
+			if !removed[filepath.Join(path, entry.Name())] {
+				empty = false
+				break
+			}
+		}
+		if !empty {
+			continue
+		}
+		removed[path] = true
+
+		if dry {
+			log.Printf("%s: dry run, not removing empty directory", rel)
+			plan.remove(true)
+			continue
+		}
+		if err := store.Remove(path); err != nil {
+			return fmt.Errorf("error removing empty directory %s: %v", path, err)
+		}
+		e := event{Event: "delete", Path: rel, Reason: "empty directory"}
+		logEvent(e, "%s: removed empty directory", rel)
+		emit(e)
+	}
+	return nil
+}
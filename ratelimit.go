@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseRate parses a transfer rate like "5MB/s", "500k", or "1048576"
+// into bytes per second. The size is read by parseSize, and may be
+// followed by /s.
+func parseRate(s string) (int64, error) {
+	t := strings.TrimSpace(s)
+	if strings.HasSuffix(strings.ToLower(t), "/s") {
+		t = t[:len(t)-2]
+	}
+	n, err := parseSize(t)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return n, nil
+}
+
+// parseSize parses a size like "500MB", "2g", or "1048576" into bytes.
+// The suffixes K, M, and G (with optional B) are powers of 1024.
+func parseSize(s string) (int64, error) {
+	t := strings.ToUpper(strings.TrimSpace(s))
+	t = strings.TrimSuffix(t, "B")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(t, "K"):
+		mult = 1024
+	case strings.HasSuffix(t, "M"):
+		mult = 1024 * 1024
+	case strings.HasSuffix(t, "G"):
+		mult = 1024 * 1024 * 1024
+	}
+	if mult > 1 {
+		t = t[:len(t)-1]
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// rateLimiter is a token bucket shared by all downloads.
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// limiter is nil when downloads are not throttled.
+var limiter *rateLimiter
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSecond), last: clk.Now()}
+}
+
+// wait blocks until n bytes may be transferred.
+func (l *rateLimiter) wait(n int) {
+	l.Lock()
+	now := clk.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+
+	// allow at most one second of burst
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.Unlock()
+	time.Sleep(delay)
+}
+
+// limitedReader throttles reads using the shared limiter.
+type limitedReader struct {
+	io.Reader
+}
+
+// limitReader wraps r so its reads count against the -max-rate limit.
+func limitReader(r io.Reader) io.Reader {
+	if limiter == nil {
+		return r
+	}
+	return limitedReader{r}
+}
+
+func (r limitedReader) Read(p []byte) (int, error) {
+	// keep reads small so concurrent downloads share fairly
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := r.Reader.Read(p)
+	limiter.wait(n)
+	return n, err
+}
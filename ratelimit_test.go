@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"0", 0},
+		{"1048576", 1048576},
+		{"500k", 500 * 1024},
+		{"500KB", 500 * 1024},
+		{" 1.5M ", 1536 * 1024},
+		{"2gb", 2 * 1024 * 1024 * 1024},
+	}
+	for _, test := range tests {
+		if got, err := parseSize(test.in); err != nil {
+			t.Errorf("parseSize(%q): %v", test.in, err)
+		} else if got != test.want {
+			t.Errorf("parseSize(%q) = %d, want %d", test.in, got, test.want)
+		}
+	}
+	for _, in := range []string{"500MB/s", "-1", "big", "5T", ""} {
+		if _, err := parseSize(in); err == nil {
+			t.Errorf("parseSize(%q) succeeded", in)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"0", 0},
+		{"1048576", 1048576},
+		{"500k", 500 * 1024},
+		{"5MB/s", 5 * 1024 * 1024},
+		{"5m/S", 5 * 1024 * 1024},
+		{"100/s", 100},
+	}
+	for _, test := range tests {
+		if got, err := parseRate(test.in); err != nil {
+			t.Errorf("parseRate(%q): %v", test.in, err)
+		} else if got != test.want {
+			t.Errorf("parseRate(%q) = %d, want %d", test.in, got, test.want)
+		}
+	}
+	for _, in := range []string{"5MB/s/s", "-1/s", "fast", "/s"} {
+		if _, err := parseRate(in); err == nil {
+			t.Errorf("parseRate(%q) succeeded", in)
+		}
+	}
+}
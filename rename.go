@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/russross/smugmug"
+)
+
+// findOrphans indexes the local files of an album that no image claims
+// by MD5 sum. Cleanup would delete these, so a file that is renamed on
+// the server can be renamed locally instead of being downloaded again
+// under its new name. It returns nil when cleanup is not going to run.
+func findOrphans(localFiles map[string]string, paths map[*smugmug.ImageInfo]string) map[string][]string {
+	if !del || noClean || !albumDirs() {
+		return nil
+	}
+	claimed := make(map[string]bool)
+	for _, path := range paths {
+		claimed[path] = true
+	}
+	orphans := make(map[string][]string)
+	for path, sum := range localFiles {
+		if sum != "directory" && !claimed[path] {
+			orphans[sum] = append(orphans[sum], path)
+		}
+	}
+	return orphans
+}
+
+// renameOrphan moves an unclaimed local file with the same contents as
+// image to path, and returns its old path (relative to dir). It returns
+// "" if there is no such file or the rename fails, in which case the
+// image should be downloaded as usual. The caller must hold the lock
+// on stats, which guards the orphans index and localFiles.
+func renameOrphan(path, fullpath string, image *smugmug.ImageInfo, localFiles map[string]string, stats *albumStats) string {
+	// video and resized rendition sums do not describe the files we download
+	if isVideo(image.Format) || imageSize != "original" || image.MD5Sum == "" {
+		return ""
+	}
+	for len(stats.orphans[image.MD5Sum]) > 0 {
+		candidates := stats.orphans[image.MD5Sum]
+		old := candidates[0]
+		stats.orphans[image.MD5Sum] = candidates[1:]
+
+		// another image may have claimed it already
+		if localFiles[old] != image.MD5Sum {
+			continue
+		}
+		oldpath := filepath.Join(dir, old)
+		if info, err := store.Stat(oldpath); err != nil || info.Size() != int64(image.Size) {
+			continue
+		}
+		if err := store.MkdirAll(filepath.Dir(fullpath)); err != nil {
+			return ""
+		}
+		if err := store.Rename(oldpath, fullpath); err != nil {
+			log.Printf("    %s: unable to rename %s, downloading instead: %v", path, old, err)
+			return ""
+		}
+		delete(localFiles, old)
+		cache.forget(old)
+		return old
+	}
+	return ""
+}
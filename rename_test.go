@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// TestRenameOrphan checks that a local file whose image was renamed on
+// the server is moved to the new name instead of being downloaded
+// again and the old copy deleted.
+func TestRenameOrphan(t *testing.T) {
+	f := newFakeSmug()
+	setup(t, f)
+	album := f.addAlbum("Travel", "Paris")
+	data := []byte("tower")
+	image := f.addImage(album, "Eiffel Tower.jpg", "JPG", data)
+	writeFile(t, "Travel/Paris/IMG_0001.jpg", data)
+
+	result := syncAccount(context.Background(), &account{provider: fakeAuth{f}})
+	if len(result.failures) > 0 {
+		t.Fatalf("failures: %v", result.failures)
+	}
+	if n := f.content.requests(image.OriginalURL); n != 0 {
+		t.Errorf("image downloaded %d times, want 0", n)
+	}
+	if got := readFile(t, "Travel/Paris/Eiffel Tower.jpg"); string(got) != string(data) {
+		t.Errorf("renamed file holds %q, want %q", got, data)
+	}
+	if readFile(t, "Travel/Paris/IMG_0001.jpg") != nil {
+		t.Errorf("old name is still present")
+	}
+}
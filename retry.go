@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// retryDelay is the wait before the first retry; it doubles after each attempt.
+const retryDelay = time.Second
+
+// backoff returns how long to wait before the given retry (starting at 1):
+// exponential growth plus up to 50% random jitter.
+func backoff(attempt int) time.Duration {
+	d := retryDelay << uint(attempt-1)
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// downloadWithRetry sends a GET request for url, retrying network errors,
+// throttling, and 5xx responses up to attempts more times with exponential backoff.
+// header holds any extra request headers. The caller must close the
+// response body. Canceling ctx aborts the request, including reading
+// the body, and stops any further retries.
+func downloadWithRetry(ctx context.Context, url string, header http.Header, attempts int) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating request for %s: %v", url, err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		resp, err := doWithTimeout(req, timeout)
+		if err != nil && isReset(err) || err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			adapt.throttled()
+		} else if err == nil && resp.StatusCode < 300 {
+			adapt.succeeded()
+		}
+		if err == nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			if attempt > 0 {
+				log.Printf("    recovered after %d retries downloading %s", attempt, url)
+			}
+			return resp, nil
+		}
+
+		// report the failure
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		if attempt >= attempts || ctx.Err() != nil {
+			return nil, fmt.Errorf("error downloading %s: %v", url, err)
+		}
+		delay := backoff(attempt + 1)
+		logWarn(event{}, "    error downloading %s: %v, retrying in %v (%d of %d)", url, err, delay.Round(time.Millisecond), attempt+1, attempts)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("error downloading %s: %v", url, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// sanitizeReplacement is substituted for characters that are not
+// allowed in file names, as set by -sanitize-replacement.
+var sanitizeReplacement = "_"
+
+// reservedNames cannot be used as file names on Windows,
+// with or without an extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeName makes a category, album, or file name safe to use as a
+// single path element on any common file system. Characters that
+// Windows forbids (including path separators), control characters,
+// and trailing dots and spaces are replaced. With -normalize-unicode,
+// the name is put in composed form (NFC). The result depends only on
+// the name, so paths are the same on every run.
+func sanitizeName(name string) string {
+	if normalize {
+		name = norm.NFC.String(name)
+	}
+	var b strings.Builder
+	for _, r := range name {
+		if r < 32 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			b.WriteString(sanitizeReplacement)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	s := b.String()
+
+	trimmed := strings.TrimRight(s, ". ")
+	s = trimmed + strings.Repeat(sanitizeReplacement, len(s)-len(trimmed))
+	if s == "" {
+		return sanitizeReplacement
+	}
+	base := s
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		base = s[:i]
+	}
+	if reservedNames[strings.ToUpper(base)] {
+		s = sanitizeReplacement + s
+	}
+	return s
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/russross/smugmug"
+)
+
+// stateSuffix marks the sidecar file that describes a download in progress.
+const stateSuffix = ".smugsync"
+
+// downloadState is the contents of a sidecar file. It records what the
+// matching .part file is supposed to become, so a later run can tell
+// whether the partial download is still good. Source tells renditions
+// apart, since a different -image-size or -video-res downloads another
+// file for the same image.
+type downloadState struct {
+	Size       int    `json:"size"`
+	MD5Sum     string `json:"md5"`
+	Source     string `json:"source"`
+	Downloaded int64  `json:"downloaded"`
+}
+
+// sourceKey identifies the file a download URL points to. The query is
+// left out, since signed URLs get new parameters when they are refreshed.
+func sourceKey(url string) string {
+	if i := strings.IndexByte(url, '?'); i >= 0 {
+		return url[:i]
+	}
+	return url
+}
+
+func readState(name string) (*downloadState, error) {
+	data, err := store.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	state := new(downloadState)
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func writeState(name string, state *downloadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error encoding download state: %v", err)
+	}
+	if err := store.WriteFile(name, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write download state %s: %v", name, err)
+	}
+	return nil
+}
+
+// fetchFile downloads url to fullpath. The data goes to a .part file
+// first, with a sidecar state file next to it, and is renamed into
+// place when complete. If an earlier run left a partial download for
+// the same version of the image and -resume is set, fetchFile resumes
+// it, or uses it as is if it is already complete. It returns the size
+// of the file. If ctx is canceled, the download stops and fetchFile
+// returns errInterrupted; the partial download is removed unless
+// -resume is set, in which case a later run picks it up. If the server
+// refuses url, as it does once a signed URL expires, refresh is called
+// for a new one and the download is retried.
+func fetchFile(ctx context.Context, path, fullpath, url string, original bool, image *smugmug.ImageInfo, refresh func() (string, error)) (int64, error) {
+	part := fullpath + partSuffix
+	sidecar := fullpath + stateSuffix
+	checkSize := original && !isVideo(image.Format)
+
+	// decide whether to resume, restart, or trust an earlier download.
+	// A partial download of another rendition is thrown away.
+	var offset int64
+	source := sourceKey(url)
+	if old, err := readState(sidecar); resume && err == nil && old.Size == image.Size && old.MD5Sum == image.MD5Sum {
+		if old.Source != source {
+			log.Printf("    %s: partial download is of another rendition, starting over", path)
+			store.Remove(part)
+		} else if info, err := store.Stat(part); err == nil {
+			offset = info.Size()
+		}
+	}
+	if checkSize && offset > int64(image.Size) {
+		offset = 0
+	}
+	state := &downloadState{Size: image.Size, MD5Sum: image.MD5Sum, Source: source, Downloaded: offset}
+	if err := store.MkdirAll(filepath.Dir(fullpath)); err != nil {
+		return 0, fmt.Errorf("failed to create directory %s: %v", filepath.Dir(fullpath), err)
+	}
+
+	size := offset
+	complete := false
+	if checkSize && offset == int64(image.Size) {
+		if sum, err := hashFile(part); err == nil && sum == image.MD5Sum {
+			log.Printf("    %s: using complete download from an earlier run", path)
+			complete = true
+		} else {
+			offset = 0
+		}
+	} else if offset > 0 {
+		log.Printf("    %s: resuming download at %d bytes", path, offset)
+	}
+
+	if !complete {
+		if err := writeState(sidecar, state); err != nil {
+			return 0, err
+		}
+		for attempt := 1; ; attempt++ {
+			var sum string
+			var err error
+			size, sum, err = download(ctx, url, part, offset)
+			if err != nil && ctx.Err() != nil {
+				if !resume {
+					store.Remove(part)
+					store.Remove(sidecar)
+				}
+				log.Printf("    %s: download canceled", path)
+				return 0, errInterrupted
+			}
+			if err != nil && isExpired(err) && attempt <= retries {
+				log.Printf("    %s: download refused, fetching a fresh URL (%d of %d)", path, attempt, retries)
+				if url, err = refresh(); err != nil {
+					return 0, fmt.Errorf("error refreshing URL: %v", err)
+				}
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			if !checkSize {
+				break
+			}
+
+			var problem string
+			if int(size) != image.Size {
+				// a short download is probably truncated, so pick up where it left off
+				problem = fmt.Sprintf("downloaded %d bytes from %s, expected %d", size, url, image.Size)
+				offset = size
+				if int(size) > image.Size || !resume {
+					offset = 0
+					if err := store.Remove(part); err != nil {
+						return 0, fmt.Errorf("failed to remove bad download %s: %v", part, err)
+					}
+				}
+			} else if verify && sum != image.MD5Sum {
+				// the data is bad, so start over
+				problem = fmt.Sprintf("downloaded file from %s has MD5 sum %s, expected %s", url, sum, image.MD5Sum)
+				offset = 0
+				if err := store.Remove(part); err != nil {
+					return 0, fmt.Errorf("failed to remove bad download %s: %v", part, err)
+				}
+			} else {
+				break
+			}
+
+			state.Downloaded = offset
+			if err := writeState(sidecar, state); err != nil {
+				return 0, err
+			}
+			if attempt > retries {
+				return 0, errors.New(problem)
+			}
+			delay := backoff(attempt)
+			log.Printf("    %s: %s, retrying in %v (%d of %d)", path, problem, delay.Round(time.Millisecond), attempt, retries)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return 0, errInterrupted
+			}
+		}
+	}
+
+	if err := store.Rename(part, fullpath); err != nil {
+		return 0, fmt.Errorf("failed to rename %s to %s: %v", part, fullpath, err)
+	}
+	if err := store.Remove(sidecar); err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to remove download state %s: %v", sidecar, err)
+	}
+	return size, nil
+}
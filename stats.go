@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// runStats summarizes a run. It is written as JSON by -stats.
+type runStats struct {
+	sync.Mutex
+	Start           time.Time `json:"start"`
+	Duration        float64   `json:"durationSeconds"`
+	AlbumsScanned   int       `json:"albumsScanned"`
+	AlbumsSkipped   int       `json:"albumsSkipped"`
+	AlbumsSynced    int       `json:"albumsSynced"`
+	FilesDownloaded int64     `json:"filesDownloaded"`
+	BytesDownloaded int64     `json:"bytesDownloaded"`
+	FilesDeleted    int       `json:"filesDeleted"`
+	Interrupted     bool      `json:"interrupted,omitempty"`
+	Errors          []string  `json:"errors"`
+}
+
+var run runStats
+
+// album records that an album was finished, either skipped or synced.
+func (s *runStats) album(skipped bool) {
+	s.Lock()
+	defer s.Unlock()
+	if skipped {
+		s.AlbumsSkipped++
+	} else {
+		s.AlbumsSynced++
+	}
+}
+
+// deleted records files and directories removed by cleanup.
+func (s *runStats) deleted(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.FilesDeleted += n
+}
+
+// fail records an error that stopped an album.
+func (s *runStats) fail(msg string) {
+	s.Lock()
+	defer s.Unlock()
+	s.Errors = append(s.Errors, msg)
+}
+
+// write saves the summary to a file.
+func (s *runStats) write(path string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.Errors == nil {
+		s.Errors = []string{}
+	}
+	data, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return fmt.Errorf("error encoding stats: %v", err)
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write stats %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// storage is where synced files are kept. Everything smugsync reads
+// or writes in the target tree goes through it: downloads and their
+// state files, hashing, renames, hard links, sidecars, the hash cache,
+// cleanup, timestamps, and the pause file. Only local disk is
+// implemented. Files outside the tree (the lock, -check-fs probes,
+// configuration, logs, and reports) use the local file system directly.
+type storage interface {
+	Stat(name string) (os.FileInfo, error)
+	Walk(root string, fn filepath.WalkFunc) error
+	ReadDir(name string) ([]os.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	OpenFile(name string, flag int) (io.WriteCloser, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte) error
+	MkdirAll(name string) error
+	Rename(oldname, newname string) error
+	Link(oldname, newname string) error
+	Remove(name string) error
+	Chtimes(name string, when time.Time) error
+}
+
+// localStorage keeps files on the local file system.
+type localStorage struct{}
+
+func (localStorage) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+func (localStorage) Walk(root string, fn filepath.WalkFunc) error { return filepath.Walk(root, fn) }
+
+func (localStorage) ReadDir(name string) ([]os.FileInfo, error) { return ioutil.ReadDir(name) }
+
+func (localStorage) Open(name string) (io.ReadCloser, error) { return os.Open(name) }
+
+func (localStorage) OpenFile(name string, flag int) (io.WriteCloser, error) {
+	return os.OpenFile(name, flag, 0644)
+}
+
+func (localStorage) ReadFile(name string) ([]byte, error) { return ioutil.ReadFile(name) }
+
+func (localStorage) WriteFile(name string, data []byte) error {
+	return ioutil.WriteFile(name, data, 0644)
+}
+
+func (localStorage) MkdirAll(name string) error { return os.MkdirAll(name, 0755) }
+
+func (localStorage) Rename(oldname, newname string) error { return os.Rename(oldname, newname) }
+
+func (localStorage) Link(oldname, newname string) error { return os.Link(oldname, newname) }
+
+func (localStorage) Remove(name string) error { return os.Remove(name) }
+
+func (localStorage) Chtimes(name string, when time.Time) error { return os.Chtimes(name, when, when) }
+
+// store is the storage backend for the target tree.
+var store storage = localStorage{}
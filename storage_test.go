@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingStorage is local storage that counts writes by kind.
+type recordingStorage struct {
+	localStorage
+	sync.Mutex
+	ops map[string]int
+}
+
+func (s *recordingStorage) record(op string) {
+	s.Lock()
+	defer s.Unlock()
+	s.ops[op]++
+}
+
+func (s *recordingStorage) OpenFile(name string, flag int) (io.WriteCloser, error) {
+	s.record("open")
+	return s.localStorage.OpenFile(name, flag)
+}
+
+func (s *recordingStorage) WriteFile(name string, data []byte) error {
+	s.record("write")
+	return s.localStorage.WriteFile(name, data)
+}
+
+func (s *recordingStorage) MkdirAll(name string) error {
+	s.record("mkdir")
+	return s.localStorage.MkdirAll(name)
+}
+
+func (s *recordingStorage) Rename(oldname, newname string) error {
+	s.record("rename")
+	return s.localStorage.Rename(oldname, newname)
+}
+
+func (s *recordingStorage) Remove(name string) error {
+	s.record("remove")
+	return s.localStorage.Remove(name)
+}
+
+func (s *recordingStorage) Chtimes(name string, when time.Time) error {
+	s.record("chtimes")
+	return s.localStorage.Chtimes(name, when)
+}
+
+// TestStorageWritePath checks that downloading goes through store.
+func TestStorageWritePath(t *testing.T) {
+	f := newFakeSmug()
+	setup(t, f)
+	recorder := &recordingStorage{ops: make(map[string]int)}
+	store = recorder
+	defer func() { store = localStorage{} }()
+	album := f.addAlbum("Travel", "Paris")
+	f.addImage(album, "IMG_0001.jpg", "JPG", []byte("tower"))
+	writeFile(t, "Travel/Paris/old.jpg", []byte("gone"))
+
+	result := syncAccount(context.Background(), &account{provider: fakeAuth{f}})
+	if len(result.failures) > 0 {
+		t.Fatalf("failures: %v", result.failures)
+	}
+	for _, op := range []string{"open", "write", "mkdir", "rename", "remove", "chtimes"} {
+		if recorder.ops[op] == 0 {
+			t.Errorf("sync made no %s calls through store", op)
+		}
+	}
+	if readFile(t, "Travel/Paris/IMG_0001.jpg") == nil || readFile(t, "Travel/Paris/old.jpg") != nil {
+		t.Errorf("sync did not update the local copy")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/russross/smugmug"
+)
+
+type treeAlbum struct {
+	Category    string      `json:"category"`
+	SubCategory string      `json:"subCategory,omitempty"`
+	Title       string      `json:"title"`
+	URL         string      `json:"url"`
+	Key         string      `json:"key"`
+	ID          int         `json:"id"`
+	LastUpdated string      `json:"lastUpdated"`
+	Error       string      `json:"error,omitempty"`
+	Images      []treeImage `json:"images"`
+}
+
+type treeImage struct {
+	FileName    string `json:"fileName"`
+	Key         string `json:"key"`
+	ID          int    `json:"id"`
+	Format      string `json:"format"`
+	Size        int    `json:"size"`
+	MD5Sum      string `json:"md5,omitempty"`
+	Date        string `json:"date,omitempty"`
+	LastUpdated string `json:"lastUpdated"`
+}
+
+// dumpTree writes the albums and their images to path as JSON, for
+// -dump-tree. The file is a snapshot of the account's structure that
+// can be compared between runs. An album whose images cannot be listed
+// is included with the error. With -accounts, the account name is
+// added to the file name so each account gets its own snapshot.
+func dumpTree(c smugClient, albums []*smugmug.AlbumInfo, path, account string) error {
+	if acctsFile != "" {
+		ext := filepath.Ext(path)
+		path = strings.TrimSuffix(path, ext) + "-" + account + ext
+	}
+
+	tree := []treeAlbum{}
+	for _, album := range albums {
+		levels := categories(album)
+		entry := treeAlbum{
+			Category:    levels[0],
+			Title:       album.Title,
+			URL:         album.URL,
+			Key:         album.Key,
+			ID:          album.ID,
+			LastUpdated: album.LastUpdated,
+			Images:      []treeImage{},
+		}
+		if len(levels) > 1 {
+			entry.SubCategory = levels[1]
+		}
+		images, err := fetchImages(context.Background(), c, album).wait()
+		if err != nil && isAccessError(err) {
+			entry.Error = err.Error()
+		} else if err != nil {
+			return fmt.Errorf("Images error in album %s: %v", album.URL, err)
+		}
+		for _, image := range images {
+			entry.Images = append(entry.Images, treeImage{
+				FileName:    image.FileName,
+				Key:         image.Key,
+				ID:          image.ID,
+				Format:      image.Format,
+				Size:        image.Size,
+				MD5Sum:      image.MD5Sum,
+				Date:        image.Date,
+				LastUpdated: image.LastUpdated,
+			})
+		}
+		tree = append(tree, entry)
+	}
+
+	data, err := json.MarshalIndent(tree, "", "    ")
+	if err != nil {
+		return fmt.Errorf("error encoding album tree: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write album tree %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %v", tmp, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/russross/smugmug"
+	"golang.org/x/text/unicode/norm"
+)
+
+// matchNormalized points images at local files whose names differ from
+// the server's only in Unicode normalization, for -normalize-unicode.
+// macOS keeps names in decomposed form (NFD) while SmugMug uses the
+// composed form (NFC), so without this, every name with an accent
+// would look like one file to download and another to delete. The
+// local file keeps its name.
+func matchNormalized(paths map[*smugmug.ImageInfo]string, localFiles map[string]string) {
+	local := make(map[string]string)
+	for name := range localFiles {
+		if nfc := norm.NFC.String(name); nfc != name {
+			local[nfc] = name
+		}
+	}
+	if len(local) == 0 {
+		return
+	}
+	for image, path := range paths {
+		if _, present := localFiles[path]; present {
+			continue
+		}
+		if name, present := local[norm.NFC.String(path)]; present {
+			paths[image] = name
+		}
+	}
+}
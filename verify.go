@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/russross/smugmug"
+	"golang.org/x/text/unicode/norm"
+)
+
+// integrity counts the problems -check finds in the local copy of an album.
+type integrity struct {
+	missing   int
+	extra     int
+	corrupted int
+}
+
+func (in *integrity) add(other *integrity) {
+	in.missing += other.missing
+	in.extra += other.extra
+	in.corrupted += other.corrupted
+}
+
+func (in *integrity) String() string {
+	return fmt.Sprintf("%d missing, %d extra, %d corrupted", in.missing, in.extra, in.corrupted)
+}
+
+// wanted reports whether the current settings would download an image,
+// so that a missing copy counts as a problem.
+func wanted(image *smugmug.ImageInfo) bool {
+	if isVideo(image.Format) && !videos || !isVideo(image.Format) && !pics {
+		return false
+	}
+	return (sizeLimit <= 0 || int64(image.Size) <= sizeLimit) && inDateRange(image)
+}
+
+// isBookkeeping reports whether a local file that no image claims was
+// written by smugsync itself, i.e., an album-level file or a sidecar.
+func isBookkeeping(rel, albumDir string, byPath map[string]*smugmug.ImageInfo) bool {
+	if filepath.Dir(rel) == albumDir {
+		switch filepath.Base(rel) {
+		case checksumsName, albumMetadataName, manifestName, emptyMarkerName, ignoreName:
+			return true
+		}
+	}
+	switch filepath.Ext(rel) {
+	case ".txt", ".json", ".tags":
+		return byPath[strings.TrimSuffix(rel, filepath.Ext(rel))] != nil
+	}
+	return false
+}
+
+// checkAlbum compares the local copy of an album with the server for
+// -check, logging each missing, extra, and corrupted file. Extra files
+// are only looked for in album directories, since other layouts share
+// directories between albums. Nothing is changed.
+func checkAlbum(c smugClient, album *smugmug.AlbumInfo) (*integrity, error) {
+	images, err := fetchImages(context.Background(), c, album).wait()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := claimPaths(album, images)
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string]*smugmug.ImageInfo)
+	for _, image := range images {
+		byPath[paths[image]] = image
+	}
+
+	found := new(integrity)
+	var problems []string
+	infos := make(map[string]os.FileInfo)
+	fullpaths := make(map[string]string)
+	if albumDirs() {
+		albumDir := albumPath(album)
+		root := filepath.Join(dir, albumDir)
+		patterns := append(ignores[:len(ignores):len(ignores)], readIgnoreFile(root)...)
+		err := store.Walk(root, func(fullpath string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() || strings.HasSuffix(fullpath, partSuffix) || strings.HasSuffix(fullpath, stateSuffix) {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, fullpath)
+			if err != nil {
+				return err
+			}
+			if normalize {
+				rel = norm.NFC.String(rel)
+			}
+			if byPath[rel] != nil {
+				infos[rel] = info
+				fullpaths[rel] = fullpath
+			} else if inAlbum, _ := filepath.Rel(root, fullpath); !isIgnored(inAlbum, patterns) && !isBookkeeping(rel, albumDir, byPath) {
+				problems = append(problems, fmt.Sprintf("%s: extra file", rel))
+				found.extra++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error walking local file system: %v", err)
+		}
+	} else {
+		for path := range byPath {
+			if info, err := store.Stat(filepath.Join(dir, path)); err == nil && !info.IsDir() {
+				infos[path] = info
+				fullpaths[path] = filepath.Join(dir, path)
+			}
+		}
+	}
+
+	// hash the files whose sums describe them
+	var toHash []hashJob
+	for path, image := range byPath {
+		info := infos[path]
+		switch {
+		case info == nil:
+			if wanted(image) {
+				problems = append(problems, fmt.Sprintf("%s: missing", path))
+				found.missing++
+			}
+		case isVideo(image.Format) || imageSize != "original" || image.MD5Sum == "":
+		case info.Size() != int64(image.Size):
+			problems = append(problems, fmt.Sprintf("%s: corrupted (size is %d, expected %d)", path, info.Size(), image.Size))
+			found.corrupted++
+		default:
+			toHash = append(toHash, hashJob{key: path, fullpath: fullpaths[path], info: info})
+		}
+	}
+	// the cache trusts size and modification time, which is exactly
+	// what bit rot leaves alone, so -check reads every file
+	sums := make(map[string]string)
+	if err := hashFiles(nil, toHash, sums); err != nil {
+		return nil, err
+	}
+	for path, sum := range sums {
+		if sum != byPath[path].MD5Sum {
+			problems = append(problems, fmt.Sprintf("%s: corrupted (MD5 sum is %s, expected %s)", path, sum, byPath[path].MD5Sum))
+			found.corrupted++
+		}
+	}
+
+	sort.Strings(problems)
+	for _, problem := range problems {
+		log.Printf("    %s", problem)
+	}
+	log.Printf("%s [%s]: %v", albumPath(album), album.URL, found)
+	return found, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCheckBypassesCache checks that -check finds a file that changed
+// without its size or modification time changing, even though the
+// cache still holds the sum it had when it was downloaded.
+func TestCheckBypassesCache(t *testing.T) {
+	f := newFakeSmug()
+	setup(t, f)
+	noCache, cache = false, &hashCache{entries: make(map[string]*cacheEntry)}
+	album := f.addAlbum("Travel", "Paris")
+	image := f.addImage(album, "IMG_0001.jpg", "JPG", []byte("tower"))
+
+	result := syncAccount(context.Background(), &account{provider: fakeAuth{f}})
+	if len(result.failures) > 0 {
+		t.Fatalf("failures: %v", result.failures)
+	}
+	path, err := imagePath(album, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullpath := filepath.Join(dir, path)
+	info, err := os.Stat(fullpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.hash(path, fullpath, info); err != nil {
+		t.Fatal(err)
+	}
+
+	// flip the contents but keep the size and timestamp
+	writeFile(t, path, []byte("TOWER"))
+	if err := os.Chtimes(fullpath, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := checkAlbum(f, album)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.corrupted != 1 || found.missing != 0 || found.extra != 0 {
+		t.Errorf("checkAlbum found %v, want 1 corrupted", found)
+	}
+}